@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/gorilla/mux"
+)
+
+// adminTokenHeader carries the admin token on requests whose Authorization
+// header is taken by the hook's own auth.
+const adminTokenHeader = "X-Captainhook-Admin-Token"
+
+// triggerHeader tells the scripts of a hook run through the admin api who
+// started it.
+const triggerHeader = "X-Captainhook-Trigger"
+
+// adminAuthorized reports whether req carries the admin token, either in the
+// admin token header, as a bearer token or as the user or password of basic
+// auth.
+func adminAuthorized(req *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	var given string
+	if h := req.Header.Get(adminTokenHeader); h != "" {
+		given = h
+	} else if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		given = strings.TrimPrefix(h, "Bearer ")
+	} else if user, pass, ok := req.BasicAuth(); ok {
+		given = user
+		if pass != "" {
+			given = pass
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(adminToken)) == 1
+}
+
+// crossOrigin reports whether r was sent by a page from another origin.
+// Browsers send the dashboard's basic auth credentials along with such
+// requests, so they must not change anything.
+func crossOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+// adminOnly wraps h so that it can only be called with the admin token.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && crossOrigin(r) {
+			log.WithFields(log.Fields{
+				"path":    r.URL.Path,
+				"address": r.RemoteAddr,
+				"origin":  r.Header.Get("Origin"),
+			}).Warn("Cross-origin admin request!")
+			http.Error(w, "Cross-origin requests are not allowed.", http.StatusForbidden)
+			return
+		}
+		if !adminAuthorized(r) {
+			log.WithFields(log.Fields{
+				"path":    r.URL.Path,
+				"address": r.RemoteAddr,
+			}).Warn("Admin Authentication Failure!")
+			w.Header().Set("WWW-Authenticate", `Basic realm="captainhook"`)
+			http.Error(w, "Not authorized.", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func adminRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/", adminOnly(dashboardHandler)).Methods("GET")
+	r.HandleFunc("/hooks", adminOnly(hooksHandler)).Methods("GET")
+	r.HandleFunc("/hooks/{id:"+hookIDPattern+"}/enable", adminOnly(enableHookHandler(false))).Methods("POST")
+	r.HandleFunc("/hooks/{id:"+hookIDPattern+"}/disable", adminOnly(enableHookHandler(true))).Methods("POST")
+	r.HandleFunc("/hooks/{id:"+hookIDPattern+"}/run", adminOnly(triggerHandler)).Methods("POST")
+	r.HandleFunc("/hooks/{id:"+hookIDPattern+"}", adminOnly(hookInfoHandler)).Methods("GET")
+	r.HandleFunc("/jobs", adminOnly(jobsHandler)).Methods("GET")
+	r.HandleFunc("/jobs/{id}", adminOnly(adminJobHandler)).Methods("GET")
+	r.HandleFunc("/jobs/{id}/replay", adminOnly(adminReplayHandler)).Methods("POST")
+	r.HandleFunc("/schedules", adminOnly(schedulesHandler)).Methods("GET")
+	r.Handle("/metrics", adminOnly(expvar.Handler().ServeHTTP)).Methods("GET")
+	return r
+}
+
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, sched.list())
+}
+
+// hookInfo describes a hook in the admin api.
+type hookInfo struct {
+	ID            string                 `json:"id"`
+	Path          string                 `json:"path"`
+	Methods       []string               `json:"methods,omitempty"`
+	Async         bool                   `json:"async,omitempty"`
+	Schedule      string                 `json:"schedule,omitempty"`
+	Enabled       bool                   `json:"enabled"`
+	DisabledSince *time.Time             `json:"disabledSince,omitempty"`
+	Error         string                 `json:"error,omitempty"`
+	LastRun       *jobStatus             `json:"lastRun,omitempty"`
+	RunBook       map[string]interface{} `json:"runbook,omitempty"`
+}
+
+// describeHook returns what the admin api shows of hook id. A runbook that
+// fails to load is still listed, with the error.
+func describeHook(id string) hookInfo {
+	info := hookInfo{ID: id, Path: "/" + id, Enabled: true, LastRun: queue.lastRun(id)}
+	if since := disabled.since(id); !since.IsZero() {
+		info.Enabled = false
+		info.DisabledSince = &since
+	}
+	rb, err := NewRunBook(id)
+	if err != nil {
+		info.Error = redactions.redact(err.Error())
+		return info
+	}
+	if rb.Path != "" {
+		info.Path = rb.Path
+	}
+	info.Methods = rb.allowedMethods()
+	info.Async = rb.Async
+	info.Schedule = rb.Schedule
+	return info
+}
+
+// hookExists reports whether there is a runbook for id.
+func hookExists(id string) bool {
+	path, err := runBookPath(id)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func hooksHandler(w http.ResponseWriter, r *http.Request) {
+	ids, err := listRunBooks()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	hooks := make([]hookInfo, 0, len(ids))
+	for _, id := range ids {
+		hooks = append(hooks, describeHook(id))
+	}
+	writeJSON(w, hooks)
+}
+
+// hookInfoHandler shows a hook with its effective runbook, secrets redacted.
+func hookInfoHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !hookExists(id) {
+		http.Error(w, "No such hook.", http.StatusNotFound)
+		return
+	}
+	info := describeHook(id)
+	if settings, err := runBookSettings(id); err == nil {
+		info.RunBook = redactSettings(settings)
+	}
+	writeJSON(w, info)
+}
+
+// enableHookHandler returns a handler that disables the hook, or enables
+// it again.
+func enableHookHandler(off bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if off && !hookExists(id) {
+			http.Error(w, "No such hook.", http.StatusNotFound)
+			return
+		}
+		if err := disabled.set(id, off); err != nil {
+			log.WithFields(log.Fields{
+				"hook":  id,
+				"error": err,
+			}).Error("Could not save disabled hooks!")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.WithFields(log.Fields{
+			"hook":    id,
+			"address": r.RemoteAddr,
+			"enabled": !off,
+		}).Info("Hook toggled through the admin api.")
+		writeJSON(w, describeHook(id))
+	}
+}
+
+// triggerHandler runs a hook as if it had been called, skipping its access
+// checks. The request body and query are handed to the scripts; query
+// parameters named param.<name> become path parameters. The run is always
+// asynchronous.
+func triggerHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rec := &auditRecord{
+		Event:      auditRequest,
+		Hook:       id,
+		Client:     clientIP(r).String(),
+		Address:    r.RemoteAddr,
+		Credential: "admin",
+	}
+	defer audit.write(rec)
+
+	if disabled.has(id) {
+		rec.deny("hook disabled")
+		http.Error(w, "Hook is disabled.", http.StatusConflict)
+		return
+	}
+	rb, err := NewRunBook(id)
+	if err != nil {
+		rec.fail(err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// The admin token is not for the scripts.
+	r.Header.Del("Authorization")
+	r.Header.Del(adminTokenHeader)
+	r.Header.Set(triggerHeader, "admin")
+	in, raw, err := gatherInput(r, rb.bodyLimit())
+	if err != nil {
+		rec.deny("bad request: " + err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for k, v := range in.Query {
+		if strings.HasPrefix(k, "param.") {
+			if in.Params == nil {
+				in.Params = make(map[string]string)
+			}
+			in.Params[strings.TrimPrefix(k, "param.")] = v
+			delete(in.Query, k)
+		}
+	}
+	rec.PayloadSHA256 = payloadHash(raw)
+
+	j, err := queue.submit(rb, in)
+	if err != nil {
+		rec.fail(err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	rec.Decision, rec.Job, rec.Outcome = auditAllowed, j.ID, string(jobQueued)
+	log.WithFields(log.Fields{
+		"hook":    id,
+		"address": r.RemoteAddr,
+		"job":     j.ID,
+	}).Info("Hook triggered through the admin api.")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(map[string]string{"id": j.ID})
+	w.Write(data)
+}
+
+func adminJobHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := queue.get(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, j.status())
+}
+
+const (
+	defaultJobListLimit = 50
+	maxJobListLimit     = 1000
+)
+
+// jobsHandler lists the latest jobs, newest first, optionally only those of
+// ?hook=id, up to ?limit=n of them.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultJobListLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit.", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxJobListLimit {
+		limit = maxJobListLimit
+	}
+	jobs := queue.recent(r.URL.Query().Get("hook"), limit)
+	if jobs == nil {
+		jobs = []jobStatus{}
+	}
+	writeJSON(w, jobs)
+}
+
+// adminReplayHandler re-runs a job with its recorded input, skipping the
+// hook's access checks. ?current=1 uses the current runbook.
+func adminReplayHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	orig, err := queue.get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	rec := &auditRecord{
+		Event:         auditRequest,
+		Hook:          orig.Hook,
+		Client:        clientIP(r).String(),
+		Address:       r.RemoteAddr,
+		Credential:    "admin",
+		PayloadSHA256: payloadHash(orig.Input.Body),
+		ReplayOf:      orig.ID,
+	}
+	defer audit.write(rec)
+	if disabled.has(orig.Hook) {
+		rec.deny("hook disabled")
+		http.Error(w, "Hook is disabled.", http.StatusConflict)
+		return
+	}
+	j, err := queue.replay(id, r.URL.Query().Get("current") != "")
+	if err != nil {
+		rec.fail(err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	queue.enqueue(j)
+	rec.Decision, rec.Job, rec.Outcome = auditAllowed, j.ID, string(jobQueued)
+	log.WithFields(log.Fields{
+		"hook":     j.Hook,
+		"address":  r.RemoteAddr,
+		"job":      j.ID,
+		"replayOf": orig.ID,
+	}).Info("Replay queued through the admin api.")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(map[string]string{"id": j.ID})
+	w.Write(data)
+}
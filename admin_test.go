@@ -0,0 +1,130 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+
+  "github.com/gorilla/mux"
+)
+
+var adminHookScript = `
+{
+  "auth": "s3cret-token",
+  "methods": ["POST", "PUT"],
+  "scripts": [{"command": "sh", "args": ["-c", "echo $CAPTAINHOOK_PARAM_ENV {{index .Headers \"X-Captainhook-Trigger\"}} {{.Headers.Authorization}}"]}]
+}`
+
+func adminRequest(t *testing.T, method, url string) (int, []byte) {
+  req, _ := http.NewRequest(method, url, nil)
+  req.Header.Set(adminTokenHeader, "admin")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer resp.Body.Close()
+  data, _ := ioutil.ReadAll(resp.Body)
+  return resp.StatusCode, data
+}
+
+func TestAdminHooks(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = filepath.Join(dir, "config")
+  os.Mkdir(configdir, 0755)
+  ioutil.WriteFile(filepath.Join(configdir, "deploy.json"), []byte(adminHookScript), 0644)
+  ioutil.WriteFile(filepath.Join(configdir, "broken.json"), []byte(`{"scripts": `), 0644)
+  adminToken = "admin"
+  defer func() { adminToken = "" }()
+  queue, _ = newJobQueue("", 1)
+  defer queue.stop()
+  disabledFile := filepath.Join(dir, "disabled.json")
+  disabled, _ = newDisabledHooks(disabledFile)
+  defer func() { disabled = &disabledHooks{ids: make(map[string]time.Time)} }()
+
+  admin := httptest.NewServer(adminRouter())
+  defer admin.Close()
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler)
+  hooks := httptest.NewServer(r)
+  defer hooks.Close()
+
+  if status, _ := adminRequest(t, "GET", admin.URL+"/hooks"); status != 200 {
+    t.Fatalf("listing hooks: got %d", status)
+  }
+  resp, _ := http.Get(admin.URL + "/hooks")
+  if resp.StatusCode != 401 {
+    t.Errorf("wanted 401 without the admin token, got %d", resp.StatusCode)
+  }
+
+  _, data := adminRequest(t, "GET", admin.URL+"/hooks")
+  var list []hookInfo
+  if err := json.Unmarshal(data, &list); err != nil {
+    t.Fatal(err)
+  }
+  if len(list) != 2 || list[0].ID != "broken" || list[0].Error == "" || list[1].ID != "deploy" || !list[1].Enabled || strings.Join(list[1].Methods, ",") != "POST,PUT" {
+    t.Errorf("unexpected hooks: %s", data)
+  }
+
+  status, data := adminRequest(t, "GET", admin.URL+"/hooks/deploy")
+  if status != 200 || strings.Contains(string(data), "s3cret-token") || !strings.Contains(string(data), `"auth": "[REDACTED]"`) {
+    t.Errorf("runbook not shown redacted: %d %s", status, data)
+  }
+  if status, _ := adminRequest(t, "GET", admin.URL+"/hooks/missing"); status != 404 {
+    t.Errorf("wanted 404 for a missing hook, got %d", status)
+  }
+
+  // Disabling is persisted and refuses calls.
+  if status, data := adminRequest(t, "POST", admin.URL+"/hooks/deploy/disable"); status != 200 || !strings.Contains(string(data), `"enabled": false`) {
+    t.Errorf("disable: %d %s", status, data)
+  }
+  if reloaded, err := newDisabledHooks(disabledFile); err != nil || !reloaded.has("deploy") {
+    t.Errorf("disabled hook was not persisted: %v", err)
+  }
+  req, _ := http.NewRequest("POST", hooks.URL+"/deploy", nil)
+  req.SetBasicAuth("s3cret-token", "")
+  resp, _ = http.DefaultClient.Do(req)
+  if resp.StatusCode != http.StatusServiceUnavailable {
+    t.Errorf("wanted 503 from a disabled hook, got %d", resp.StatusCode)
+  }
+  if status, _ := adminRequest(t, "POST", admin.URL+"/hooks/deploy/run"); status != http.StatusConflict {
+    t.Errorf("wanted 409 triggering a disabled hook, got %d", status)
+  }
+  adminRequest(t, "POST", admin.URL+"/hooks/deploy/enable")
+  if disabled.has("deploy") {
+    t.Error("hook was not enabled")
+  }
+
+  // Triggering runs the hook without its auth and without the admin token.
+  status, data = adminRequest(t, "POST", admin.URL+"/hooks/deploy/run?param.env=prod")
+  if status != http.StatusAccepted {
+    t.Fatalf("trigger: %d %s", status, data)
+  }
+  var queued map[string]string
+  json.Unmarshal(data, &queued)
+  var job jobStatus
+  for i := 0; i < 100 && job.State != jobSucceeded; i++ {
+    time.Sleep(10 * time.Millisecond)
+    _, data = adminRequest(t, "GET", admin.URL+"/jobs/"+queued["id"])
+    json.Unmarshal(data, &job)
+  }
+  if job.State != jobSucceeded || job.Response.Results[0].Stdout != "prod admin\n" {
+    t.Errorf("unexpected job: %s", data)
+  }
+  if last := describeHook("deploy").LastRun; last == nil || last.ID != queued["id"] {
+    t.Errorf("last run not recorded: %+v", last)
+  }
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	auditRequest = "request"
+	auditJob     = "job"
+
+	auditAllowed = "allowed"
+	auditDenied  = "denied"
+	auditError   = "error"
+)
+
+// auditRecord is one line of the audit log. Request records say who called
+// which hook and what was decided; job records give the outcome of every job,
+// however it was started.
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Hook          string    `json:"hook"`
+	Client        string    `json:"client,omitempty"`
+	Address       string    `json:"address,omitempty"`
+	Credential    string    `json:"credential,omitempty"`
+	CertCN        string    `json:"certCN,omitempty"`
+	Subject       string    `json:"subject,omitempty"`
+	Decision      string    `json:"decision,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	PayloadSHA256 string    `json:"payloadSHA256,omitempty"`
+	Job           string    `json:"job,omitempty"`
+	ReplayOf      string    `json:"replayOf,omitempty"`
+	Outcome       string    `json:"outcome,omitempty"`
+	Prev          string    `json:"prev,omitempty"`
+	Hash          string    `json:"hash,omitempty"`
+}
+
+func (rec *auditRecord) deny(reason string) {
+	rec.Decision = auditDenied
+	rec.Reason = reason
+}
+
+func (rec *auditRecord) fail(err error) {
+	rec.Decision = auditError
+	rec.Reason = err.Error()
+}
+
+// auditLog appends records as JSON lines to a file or syslog. With chain set
+// every record carries the hash of the one before it, so removed or edited
+// lines break the chain.
+type auditLog struct {
+	mu    sync.Mutex
+	w     io.Writer
+	file  *os.File
+	chain bool
+	last  string
+}
+
+// audit is the audit log, nil unless -audit-log is given.
+var audit *auditLog
+
+// newAuditLog opens dest, which is a file, "syslog" for the local syslog or
+// "syslog://host:port" for a remote one over UDP. The chain of a file is
+// continued from its last record.
+func newAuditLog(dest string, chain bool) (*auditLog, error) {
+	a := &auditLog{chain: chain}
+	switch {
+	case dest == "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "captainhook")
+		if err != nil {
+			return nil, err
+		}
+		a.w = w
+	case strings.HasPrefix(dest, "syslog://"):
+		w, err := syslog.Dial("udp", strings.TrimPrefix(dest, "syslog://"), syslog.LOG_INFO|syslog.LOG_AUTH, "captainhook")
+		if err != nil {
+			return nil, err
+		}
+		a.w = w
+	default:
+		if chain {
+			last, err := lastAuditHash(dest)
+			if err != nil {
+				return nil, err
+			}
+			a.last = last
+		}
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.w, a.file = f, f
+	}
+	return a, nil
+}
+
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var last string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+			last = rec.Hash
+		}
+	}
+	return last, scanner.Err()
+}
+
+func chainHash(prev string, data []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev + "\n"))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// write appends rec to the log. It does nothing if there is no audit log.
+func (a *auditLog) write(rec *auditRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	rec.Prev, rec.Hash = "", ""
+	if a.chain {
+		rec.Prev = a.last
+		data, err := json.Marshal(rec)
+		if err != nil {
+			log.WithField("error", err).Error("Failed to write audit record!")
+			return
+		}
+		rec.Hash = chainHash(rec.Prev, data)
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		_, err = a.w.Write(append(data, '\n'))
+	}
+	if err == nil && a.file != nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":  rec.Hook,
+			"error": err,
+		}).Error("Failed to write audit record!")
+		return
+	}
+	if a.chain {
+		a.last = rec.Hash
+	}
+}
+
+// verifyAuditChain checks the hash chain of an audit log and returns the
+// number of records in it.
+func verifyAuditChain(rd io.Reader) (int, error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, 1<<20)
+	n := 0
+	prev := ""
+	for scanner.Scan() {
+		n++
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("record %d: %v", n, err)
+		}
+		if rec.Prev != prev {
+			return n, fmt.Errorf("record %d: does not follow the record before it", n)
+		}
+		hash := rec.Hash
+		rec.Hash = ""
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return n, err
+		}
+		if hash == "" || chainHash(prev, data) != hash {
+			return n, fmt.Errorf("record %d: hash does not match", n)
+		}
+		prev = hash
+	}
+	return n, scanner.Err()
+}
+
+// payloadHash is the hex SHA-256 of a request body.
+func payloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+func readAuditLog(t *testing.T, path string) []auditRecord {
+  f, err := os.Open(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  var recs []auditRecord
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    var rec auditRecord
+    if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+      t.Fatal(err)
+    }
+    recs = append(recs, rec)
+  }
+  return recs
+}
+
+func TestAuditChain(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "audit.log")
+
+  a, err := newAuditLog(path, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  a.write(&auditRecord{Event: auditRequest, Hook: "one", Decision: auditAllowed})
+  a.write(&auditRecord{Event: auditJob, Hook: "one", Outcome: "succeeded"})
+  a.file.Close()
+
+  // The chain carries on after a restart.
+  a, err = newAuditLog(path, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  a.write(&auditRecord{Event: auditRequest, Hook: "two", Decision: auditDenied, Reason: "address not allowed"})
+  a.file.Close()
+
+  data, _ := ioutil.ReadFile(path)
+  if n, err := verifyAuditChain(bytes.NewReader(data)); err != nil || n != 3 {
+    t.Fatalf("wanted 3 verified records, got %d: %v", n, err)
+  }
+
+  lines := strings.SplitAfter(string(data), "\n")
+  tests := []struct {
+    name string
+    log  string
+  }{
+    {"edited", strings.Replace(string(data), "address not allowed", "allowed", 1)},
+    {"removed", lines[0] + lines[2]},
+    {"reordered", lines[1] + lines[0] + lines[2]},
+  }
+  for _, tt := range tests {
+    if _, err := verifyAuditChain(strings.NewReader(tt.log)); err == nil {
+      t.Errorf("%s log unexpectedly verified", tt.name)
+    }
+  }
+}
+
+func TestAuditedHook(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  queue, _ = newJobQueue("", 0)
+  script := `{"auth": {"name": "ci", "token": "secret"}, "scripts": [{"command": "true"}]}`
+  ioutil.WriteFile(filepath.Join(dir, "audited.json"), []byte(script), 0644)
+  path := filepath.Join(dir, "audit.log")
+  if audit, err = newAuditLog(path, false); err != nil {
+    t.Fatal(err)
+  }
+  defer func() { audit = nil }()
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  for _, token := range []string{"wrong", "secret"} {
+    req, _ := http.NewRequest("POST", ts.URL+"/audited", strings.NewReader("payload"))
+    req.SetBasicAuth(token, "")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+  }
+
+  recs := readAuditLog(t, path)
+  if len(recs) != 3 {
+    t.Fatalf("wanted 3 audit records, got %d: %+v", len(recs), recs)
+  }
+  if recs[0].Decision != auditDenied || recs[0].Reason != "authentication failed" || recs[0].Client != "127.0.0.1" {
+    t.Errorf("unexpected denial record: %+v", recs[0])
+  }
+  // The job record is written before the request finishes.
+  job, req := recs[1], recs[2]
+  if req.Decision != auditAllowed || req.Credential != "ci" || req.Job == "" || req.Outcome != string(jobSucceeded) {
+    t.Errorf("unexpected request record: %+v", req)
+  }
+  if req.PayloadSHA256 != payloadHash([]byte("payload")) {
+    t.Errorf("wrong payload hash %s", req.PayloadSHA256)
+  }
+  if job.Event != auditJob || job.Job != req.Job || job.Outcome != string(jobSucceeded) {
+    t.Errorf("unexpected job record: %+v", job)
+  }
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	schemeBasic  = "basic"
+	schemeBearer = "bearer"
+	schemeHeader = "header"
+
+	// defaultTokenHeader is used by the header scheme when no header is set.
+	defaultTokenHeader = "X-Hook-Token"
+)
+
+// credential is one accepted secret for a runbook. The secret is given
+// literally as Token or read from the environment or a file each time it is
+// checked, so that it can be rotated without touching the runbook.
+type credential struct {
+	Name      string     `json:"name,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	FromEnv   string     `json:"fromEnv,omitempty"`
+	FromFile  string     `json:"fromFile,omitempty"`
+	Scheme    string     `json:"scheme,omitempty"`
+	Header    string     `json:"header,omitempty"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+}
+
+// credentials is its own type so that "auth" can be a plain token, a single
+// credential or a list of either.
+type credentials []credential
+
+// UnmarshalJSON for custom type credentials
+func (creds *credentials) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	list := true
+	if err := json.Unmarshal(data, &raw); err != nil {
+		raw = []json.RawMessage{data}
+		list = false
+	}
+	parsed := make(credentials, 0, len(raw))
+	for i, item := range raw {
+		var c credential
+		var token string
+		if err := json.Unmarshal(item, &token); err == nil {
+			// A bare "" means no auth, but an empty entry in a list is a
+			// mistake that would leave the hook open.
+			if token == "" && list {
+				return fmt.Errorf("auth entry %d is an empty token", i)
+			}
+			if token == "" {
+				continue
+			}
+			c.Token = token
+		} else if err := json.Unmarshal(item, &c); err != nil {
+			return err
+		}
+		if err := c.validate(); err != nil {
+			return err
+		}
+		parsed = append(parsed, c)
+	}
+	*creds = parsed
+	return nil
+}
+
+func (c *credential) validate() error {
+	sources := 0
+	for _, s := range []string{c.Token, c.FromEnv, c.FromFile} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("auth credential '%s' needs exactly one of token, fromEnv and fromFile", c.name())
+	}
+	switch c.Scheme {
+	case "", schemeBasic, schemeBearer, schemeHeader:
+	default:
+		return fmt.Errorf("auth credential '%s' has unknown scheme '%s'", c.name(), c.Scheme)
+	}
+	return nil
+}
+
+func (c *credential) name() string {
+	switch {
+	case c.Name != "":
+		return c.Name
+	case c.FromEnv != "":
+		return "env:" + c.FromEnv
+	case c.FromFile != "":
+		return "file:" + c.FromFile
+	}
+	return "token"
+}
+
+// secret returns the current value of the credential.
+func (c *credential) secret() (string, error) {
+	v := c.Token
+	switch {
+	case c.FromEnv != "":
+		v = os.Getenv(c.FromEnv)
+		if v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", c.FromEnv)
+		}
+	case c.FromFile != "":
+		data, err := ioutil.ReadFile(c.FromFile)
+		if err != nil {
+			return "", err
+		}
+		v = strings.TrimSpace(string(data))
+	}
+	redactions.addSecret(v)
+	return v, nil
+}
+
+// registerSecrets has the current values of creds redacted from the moment
+// the runbook is loaded, rather than from the first request checked against
+// them. Values that cannot be read yet are left for that check to report.
+func (creds credentials) registerSecrets() {
+	for i := range creds {
+		creds[i].secret()
+	}
+}
+
+// active reports whether now is inside the credential's rotation window.
+func (c *credential) active(now time.Time) bool {
+	if c.NotBefore != nil && now.Before(*c.NotBefore) {
+		return false
+	}
+	if c.NotAfter != nil && now.After(*c.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// presented returns the values req offers for the credential's scheme.
+func (c *credential) presented(req *http.Request) []string {
+	switch c.Scheme {
+	case schemeBearer:
+		h := req.Header.Get("Authorization")
+		if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+			return []string{h[7:]}
+		}
+	case schemeHeader:
+		header := c.Header
+		if header == "" {
+			header = defaultTokenHeader
+		}
+		if h := req.Header.Get(header); h != "" {
+			return []string{h}
+		}
+	default:
+		// The token has always been sent as the basic auth user, but the
+		// password is the more natural place for it.
+		if user, pass, ok := req.BasicAuth(); ok {
+			return []string{user, pass}
+		}
+	}
+	return nil
+}
+
+// matches reports whether req presents the credential.
+func (c *credential) matches(req *http.Request, now time.Time) bool {
+	if !c.active(now) {
+		return false
+	}
+	secret, err := c.secret()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"credential": c.name(),
+			"error":      err,
+		}).Error("Could not read credential!")
+		return false
+	}
+	if secret == "" {
+		return false
+	}
+	matched := 0
+	for _, v := range c.presented(req) {
+		matched |= subtle.ConstantTimeCompare([]byte(v), []byte(secret))
+	}
+	return matched == 1
+}
+
+// authenticate returns the name of the first credential req presents.
+func (creds credentials) authenticate(req *http.Request) (string, bool) {
+	now := time.Now()
+	for i := range creds {
+		if creds[i].matches(req, now) {
+			return creds[i].name(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestCredentialsUnmarshalling(t *testing.T) {
+  tests := []struct {
+    auth string
+    n    int
+    ok   bool
+  }{
+    {`""`, 0, true},
+    {`"token"`, 1, true},
+    {`{"fromEnv": "TOKEN", "scheme": "bearer"}`, 1, true},
+    {`["old", {"token": "new", "notBefore": "2015-06-01T00:00:00Z"}]`, 2, true},
+    {`{"token": "a", "fromFile": "/run/secrets/a"}`, 0, false},
+    {`{"scheme": "bearer"}`, 0, false},
+    {`{"token": "a", "scheme": "digest"}`, 0, false},
+    {`[""]`, 0, false},
+    {`["a", ""]`, 0, false},
+  }
+  for _, tt := range tests {
+    r := runBook{}
+    err := json.Unmarshal([]byte(`{"auth": `+tt.auth+`}`), &r)
+    if (err == nil) != tt.ok {
+      t.Errorf("unmarshalling auth %s: unexpected error %v", tt.auth, err)
+      continue
+    }
+    if len(r.Auth) != tt.n {
+      t.Errorf("unmarshalling auth %s: wanted %d credentials, got %d", tt.auth, tt.n, len(r.Auth))
+    }
+  }
+}
+
+func TestAuthorized(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  secretFile := filepath.Join(dir, "secret")
+  if err := ioutil.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  os.Setenv("CAPTAINHOOK_TEST_TOKEN", "from-env")
+  defer os.Unsetenv("CAPTAINHOOK_TEST_TOKEN")
+
+  past := time.Now().Add(-time.Hour)
+  future := time.Now().Add(time.Hour)
+  r := runBook{Auth: credentials{
+    {Token: "legacy"},
+    {FromEnv: "CAPTAINHOOK_TEST_TOKEN", Scheme: schemeBearer},
+    {FromFile: secretFile, Scheme: schemeHeader, Header: "X-Token"},
+    {Token: "expired", NotAfter: &past},
+    {Token: "upcoming", NotBefore: &future},
+    {FromEnv: "CAPTAINHOOK_TEST_UNSET"},
+  }}
+
+  tests := []struct {
+    set  func(*http.Request)
+    want bool
+  }{
+    {func(req *http.Request) {}, false},
+    {func(req *http.Request) { req.SetBasicAuth("legacy", "") }, true},
+    {func(req *http.Request) { req.SetBasicAuth("", "legacy") }, true},
+    {func(req *http.Request) { req.SetBasicAuth("wrong", "") }, false},
+    {func(req *http.Request) { req.Header.Set("Authorization", "Bearer from-env") }, true},
+    {func(req *http.Request) { req.SetBasicAuth("from-env", "") }, false},
+    {func(req *http.Request) { req.Header.Set("X-Token", "from-file") }, true},
+    {func(req *http.Request) { req.Header.Set("X-Hook-Token", "from-file") }, false},
+    {func(req *http.Request) { req.SetBasicAuth("expired", "") }, false},
+    {func(req *http.Request) { req.SetBasicAuth("upcoming", "") }, false},
+    {func(req *http.Request) { req.SetBasicAuth("", "") }, false},
+  }
+  for i, tt := range tests {
+    req, _ := http.NewRequest("POST", "/test", nil)
+    tt.set(req)
+    if got := r.Authorized(req); got != tt.want {
+      t.Errorf("test %d: wanted %v, got %v", i, tt.want, got)
+    }
+  }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultMaxBodyBytes = 10 << 20
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// bodyLimit is the largest request body the runbook accepts, after decoding.
+// 0 means no limit.
+func (r *runBook) bodyLimit() int64 {
+	if r.MaxBodyBytes > 0 {
+		return r.MaxBodyBytes
+	}
+	return maxBodyBytes
+}
+
+// ContentTypeIsAllowed reports whether a request with Content-Type ct may
+// call the runbook. Entries in allowedContentTypes may end in /* to allow a
+// whole family of types.
+func (r *runBook) ContentTypeIsAllowed(ct string) bool {
+	if len(r.AllowedContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range r.AllowedContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLimited reads all of rd, failing with errBodyTooLarge once more than
+// limit bytes have been read.
+func readLimited(rd io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(rd)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// readBody reads the raw request body.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	if limit > 0 && r.ContentLength > limit {
+		return nil, errBodyTooLarge
+	}
+	return readLimited(r.Body, limit)
+}
+
+// decodeBody undoes gzip content encoding and turns form posts into JSON, so
+// that scripts see the payload the same way however it was sent. A form with
+// a single payload field, as GitHub sends, is replaced by that field.
+func decodeBody(h http.Header, raw []byte, limit int64) ([]byte, error) {
+	body := raw
+	switch strings.ToLower(h.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = readLimited(zr, limit); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported content encoding '" + h.Get("Content-Encoding") + "'")
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return body, nil
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	if payload, ok := form["payload"]; ok && len(form) == 1 && len(payload) == 1 {
+		return []byte(payload[0]), nil
+	}
+	fields := make(map[string]interface{}, len(form))
+	for k, v := range form {
+		if len(v) == 1 {
+			fields[k] = v[0]
+		} else {
+			fields[k] = v
+		}
+	}
+	return json.Marshal(fields)
+}
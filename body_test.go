@@ -0,0 +1,122 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+func gzipped(s string) []byte {
+  var buf bytes.Buffer
+  zw := gzip.NewWriter(&buf)
+  zw.Write([]byte(s))
+  zw.Close()
+  return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+  form := "application/x-www-form-urlencoded"
+  tests := []struct {
+    contentType string
+    encoding    string
+    raw         []byte
+    want        string
+    err         bool
+  }{
+    {"application/json", "", []byte(`{"a":1}`), `{"a":1}`, false},
+    {form, "", []byte(`payload=%7B%22a%22%3A1%7D`), `{"a":1}`, false},
+    {form + "; charset=utf-8", "", []byte(`text=hi&user=bob&user=eve`), `{"text":"hi","user":["bob","eve"]}`, false},
+    {"application/json", "gzip", gzipped(`{"a":1}`), `{"a":1}`, false},
+    {form, "gzip", gzipped(`payload=x`), `x`, false},
+    {"application/json", "gzip", []byte(`not gzip`), "", true},
+    {"application/json", "br", []byte(`{}`), "", true},
+    {"application/json", "gzip", gzipped(strings.Repeat("a", 100)), "", true},
+  }
+  for i, tt := range tests {
+    h := http.Header{"Content-Type": {tt.contentType}}
+    if tt.encoding != "" {
+      h.Set("Content-Encoding", tt.encoding)
+    }
+    got, err := decodeBody(h, tt.raw, 64)
+    if tt.err {
+      if err == nil {
+        t.Errorf("test %d: unexpectedly decoded to %q", i, got)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("test %d: %v", i, err)
+      continue
+    }
+    if string(got) != tt.want {
+      t.Errorf("test %d: wanted %q, got %q", i, tt.want, got)
+    }
+  }
+}
+
+func TestContentTypeIsAllowed(t *testing.T) {
+  r := runBook{AllowedContentTypes: []string{"application/json", "text/*"}}
+  tests := []struct {
+    contentType string
+    want        bool
+  }{
+    {"application/json", true},
+    {"Application/JSON; charset=utf-8", true},
+    {"text/plain", true},
+    {"application/x-www-form-urlencoded", false},
+    {"", false},
+  }
+  for _, tt := range tests {
+    if got := r.ContentTypeIsAllowed(tt.contentType); got != tt.want {
+      t.Errorf("ContentTypeIsAllowed(%q): wanted %v, got %v", tt.contentType, tt.want, got)
+    }
+  }
+}
+
+func TestBodyLimits(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  queue, _ = newJobQueue("", 0)
+  script := `{"maxBodyBytes": 16, "allowedContentTypes": ["application/json"], "scripts": [{"command": "true"}]}`
+  ioutil.WriteFile(filepath.Join(dir, "small.json"), []byte(script), 0644)
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  tests := []struct {
+    contentType string
+    body        string
+    statusCode  int
+  }{
+    {"application/json", `{"ok":true}`, 200},
+    {"application/json", `{"ok":"this is too long"}`, 413},
+    {"text/plain", `ok`, 415},
+  }
+  for _, tt := range tests {
+    resp, err := http.Post(ts.URL+"/small", tt.contentType, strings.NewReader(tt.body))
+    if err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != tt.statusCode {
+      t.Errorf("%s %q: wanted %d, got %d", tt.contentType, tt.body, tt.statusCode, resp.StatusCode)
+    }
+  }
+}
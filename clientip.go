@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the peers whose forwarding headers are believed.
+var trustedProxies Networks
+
+// The forwarding headers a proxy can be set to use with -forwarded-header.
+const (
+	headerXFF       = "xff"
+	headerForwarded = "forwarded"
+	headerXRealIP   = "x-real-ip"
+)
+
+// forwardedHeader is the one forwarding header trusted proxies set. The
+// others are passed through from clients and must not be believed.
+var forwardedHeader = headerXFF
+
+func validateForwardedHeader(h string) error {
+	switch h {
+	case headerXFF, headerForwarded, headerXRealIP:
+		return nil
+	}
+	return fmt.Errorf("forwarded-header must be %s, %s or %s, got '%s'", headerXFF, headerForwarded, headerXRealIP, h)
+}
+
+// String for flag.Value
+func (nets *Networks) String() string {
+	ns := make([]string, len(nets.Networks))
+	for i, nw := range nets.Networks {
+		ns[i] = nw.String()
+	}
+	return strings.Join(ns, ",")
+}
+
+// Set for flag.Value, takes a comma separated list of CIDRs or addresses.
+func (nets *Networks) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		nets.Networks = append(nets.Networks, *ipnet)
+	}
+	return nil
+}
+
+// Contains reports whether ip is in any of the networks.
+func (nets *Networks) Contains(ip net.IP) bool {
+	for _, nw := range nets.Networks {
+		if nw.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIP parses the address part of "host:port", "[v6]:port" or a bare
+// address.
+func hostIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.LastIndex(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+	return net.ParseIP(addr)
+}
+
+// forwardedFor returns the addresses in the "for" parameters of a Forwarded
+// header (RFC 7239), nearest client first. Obfuscated and unknown nodes are
+// returned as nil.
+func forwardedFor(header []string) []net.IP {
+	var ips []net.IP
+	for _, h := range header {
+		for _, elem := range strings.Split(h, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				ips = append(ips, hostIP(strings.Trim(kv[1], `"`)))
+			}
+		}
+	}
+	return ips
+}
+
+// forwardedChain returns the client addresses claimed by the forwarding
+// header of r that the proxies set, nearest client first.
+func forwardedChain(r *http.Request) []net.IP {
+	switch forwardedHeader {
+	case headerForwarded:
+		return forwardedFor(r.Header["Forwarded"])
+	case headerXRealIP:
+		if h := r.Header.Get("X-Real-IP"); h != "" {
+			return []net.IP{hostIP(h)}
+		}
+		return nil
+	}
+	var ips []net.IP
+	if h := r.Header["X-Forwarded-For"]; len(h) > 0 {
+		for _, addr := range strings.Split(strings.Join(h, ","), ",") {
+			ips = append(ips, hostIP(addr))
+		}
+	}
+	return ips
+}
+
+// clientIP returns the address of the client that made r. Forwarding headers
+// are only honored when the direct peer is a trusted proxy, and are followed
+// back through further trusted proxies to the first untrusted address.
+func clientIP(r *http.Request) net.IP {
+	ip := hostIP(r.RemoteAddr)
+	if ip == nil || !trustedProxies.Contains(ip) {
+		return ip
+	}
+	chain := forwardedChain(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == nil {
+			// An address we cannot check; nothing before it can be trusted.
+			return ip
+		}
+		ip = chain[i]
+		if !trustedProxies.Contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
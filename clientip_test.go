@@ -0,0 +1,53 @@
+package main
+
+import (
+  "net"
+  "net/http"
+  "testing"
+)
+
+func TestClientIP(t *testing.T) {
+  trustedProxies = Networks{}
+  if err := trustedProxies.Set("10.0.0.0/8, 2001:db8::1"); err != nil {
+    t.Fatal(err)
+  }
+  defer func() { trustedProxies = Networks{} }()
+
+  tests := []struct {
+    header  string
+    remote  string
+    headers map[string]string
+    want    string
+  }{
+    {headerXFF, "192.0.2.1:1234", nil, "192.0.2.1"},
+    {headerXFF, "[2001:db8::2]:1234", nil, "2001:db8::2"},
+    {headerXFF, "[fe80::1%eth0]:1234", nil, "fe80::1"},
+    // Headers from untrusted peers are ignored.
+    {headerXFF, "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "192.0.2.1"},
+    {headerXFF, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+    {headerXFF, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+    {headerXFF, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "10.2.2.2"}, "10.2.2.2"},
+    {headerXFF, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "garbage, 10.2.2.2"}, "10.2.2.2"},
+    {headerXFF, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.7, garbage"}, "10.1.2.3"},
+    {headerXRealIP, "10.1.2.3:1234", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+    {headerForwarded, "[2001:db8::1]:443", map[string]string{"Forwarded": `for="[2001:db8::7]:4711";proto=https`}, "2001:db8::7"},
+    {headerForwarded, "10.1.2.3:1234", map[string]string{"Forwarded": "for=192.0.2.60;proto=http, for=198.51.100.17", "X-Forwarded-For": "203.0.113.9"}, "198.51.100.17"},
+    {headerForwarded, "10.1.2.3:1234", map[string]string{"Forwarded": "for=unknown"}, "10.1.2.3"},
+    // Only the header the proxies set is read; clients can send the others.
+    {headerXFF, "10.1.2.3:1234", map[string]string{"Forwarded": "for=127.0.0.1", "X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+    {headerXFF, "10.1.2.3:1234", map[string]string{"X-Real-IP": "127.0.0.1"}, "10.1.2.3"},
+    {headerXRealIP, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "127.0.0.1", "X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+    {headerForwarded, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "127.0.0.1"}, "10.1.2.3"},
+  }
+  defer func() { forwardedHeader = headerXFF }()
+  for _, tt := range tests {
+    forwardedHeader = tt.header
+    r := &http.Request{RemoteAddr: tt.remote, Header: make(http.Header)}
+    for k, v := range tt.headers {
+      r.Header.Set(k, v)
+    }
+    if got := clientIP(r); !got.Equal(net.ParseIP(tt.want)) {
+      t.Errorf("clientIP(%s, %v) with %s: wanted %s, got %s", tt.remote, tt.headers, tt.header, tt.want, got)
+    }
+  }
+}
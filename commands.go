@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// runCommand runs the subcommand named by args[0] and returns the exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "replay":
+		return replayCommand(args[1:])
+	case "run":
+		return runHookCommand(args[1:])
+	case "config":
+		return configCommand(args[1:])
+	case "schema":
+		return schemaCommand()
+	case "verify-audit":
+		return verifyAuditCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+}
+
+// configFree reports whether the command can run without a configdir.
+func configFree(command string) bool {
+	switch command {
+	case "config", "schema", "verify-audit":
+		return true
+	}
+	return false
+}
+
+// replayCommand re-runs a recorded job in this process and prints the new
+// job as JSON. It exits non-zero if the new job did not succeed.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	current := fs.Bool("current", false, "use the current runbook instead of the recorded one")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: captainhook -configdir <dir> -datadir <dir> replay [-current] <job-id>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if dataDir == "" {
+		os.Stderr.WriteString("replay requires -datadir\n")
+		return 1
+	}
+
+	q, err := newJobQueue(filepath.Join(dataDir, "jobs"), 0)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	j, err := q.replay(fs.Arg(0), *current)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	q.run(j)
+
+	data, err := json.MarshalIndent(j.status(), "", "  ")
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	if j.State != jobSucceeded {
+		return 1
+	}
+	return 0
+}
+
+// headerFlags collects repeated "-header K:V" flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return fmt.Sprintf("%v", http.Header(h))
+}
+
+func (h headerFlags) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i < 1 {
+		return fmt.Errorf("header must be K:V, got %q", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+	return nil
+}
+
+// paramFlags collects repeated "-param name=value" flags.
+type paramFlags map[string]string
+
+func (p paramFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(p))
+}
+
+func (p paramFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 1 {
+		return fmt.Errorf("param must be name=value, got %q", v)
+	}
+	p[v[:i]] = v[i+1:]
+	return nil
+}
+
+// runHookCommand executes a runbook in this process as if it had been called
+// over HTTP, skipping network and auth checks, and prints the response. It
+// exits with the status of the first script that failed.
+func runHookCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	bodyFile := fs.String("body", "", "file to read the request body from (- for STDIN)")
+	dryRun := fs.Bool("dry-run", false, "print what would be run instead of running it")
+	headers := make(headerFlags)
+	fs.Var(headers, "header", "request header as K:V (may be repeated)")
+	params := make(paramFlags)
+	fs.Var(params, "param", "path parameter as name=value (may be repeated)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: captainhook -configdir <dir> run [-dry-run] [-body file] [-header K:V]... [-param name=value]... <hook-id>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var body []byte
+	var err error
+	switch *bodyFile {
+	case "":
+	case "-":
+		body, err = ioutil.ReadAll(os.Stdin)
+	default:
+		body, err = ioutil.ReadFile(*bodyFile)
+	}
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+
+	rb, err := NewRunBook(fs.Arg(0))
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	req, err := http.NewRequest("POST", "/"+rb.ID, bytes.NewReader(body))
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	req.Header = http.Header(headers)
+	in, _, err := gatherInput(req, 0)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	if len(params) > 0 {
+		in.Params = params
+	}
+
+	if *dryRun {
+		plan, err := rb.plan(in)
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			return 1
+		}
+		rb.redactPlan(plan)
+		data, err := json.MarshalIndent(dryRunResponse{Hook: rb.ID, Async: rb.Async, Scripts: plan}, "", "  ")
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			return 1
+		}
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+
+	response, err := rb.execute(in)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	rb.redactResponse(response)
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	return response.exitCode()
+}
+
+// configCommand prints the effective server configuration, after the config
+// file and command line flags have been merged.
+func configCommand(args []string) int {
+	if len(args) != 1 || args[0] != "print" {
+		fmt.Fprintf(os.Stderr, "Usage: captainhook [-config file] [flags] config print\n")
+		return 2
+	}
+	data, err := yaml.Marshal(effectiveConfig())
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
+
+// schemaCommand prints the JSON schema of runbooks.
+func schemaCommand() int {
+	data, err := json.MarshalIndent(runBookSchema(), "", "  ")
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	return 0
+}
+
+// verifyAuditCommand checks the hash chain of an audit log file.
+func verifyAuditCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: captainhook verify-audit <file>\n")
+		return 2
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	defer f.Close()
+	n, err := verifyAuditChain(f)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	fmt.Printf("%d records verified\n", n)
+	return 0
+}
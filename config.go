@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags that make no sense in a config file.
+var configOnlyOnCommandLine = map[string]bool{
+	"config":  true,
+	"version": true,
+}
+
+// runBookDefaults are the settings from the config file that every runbook
+// inherits, beneath any _defaults files in the configdir.
+var runBookDefaults map[string]interface{}
+
+// configValue turns a config file value into a flag value.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int, int64, uint64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, x := range v {
+			var err error
+			if s[i], err = configValue(x); err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(s, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// loadConfig reads the server config file at path. Its keys are the names
+// of the command line flags, plus "defaults" for the settings runbooks
+// inherit. Flags given on the command line take precedence.
+func loadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	settings, err := decodeSettings(path, data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := settings[name]
+		if name == "defaults" {
+			defaults, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: defaults must be a mapping", path)
+			}
+			if err := checkDefaults(defaults); err != nil {
+				return fmt.Errorf("%s: defaults: %v", path, err)
+			}
+			runBookDefaults = defaults
+			continue
+		}
+		if flag.Lookup(name) == nil || configOnlyOnCommandLine[name] {
+			return fmt.Errorf("%s: unknown setting '%s'", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		s, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		if err := flag.Set(name, s); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// checkDefaults makes sure the defaults are valid runbook settings, so that
+// mistakes show up at startup rather than on the first call.
+func checkDefaults(defaults map[string]interface{}) error {
+	if err := checkFields("defaults", defaults); err != nil {
+		return err
+	}
+	data, err := json.Marshal(defaults)
+	if err != nil {
+		return err
+	}
+	var r runBook
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	return r.validate()
+}
+
+// effectiveConfig returns the settings captainhook runs with, after the
+// config file and the command line have been applied, with secrets redacted.
+func effectiveConfig() map[string]interface{} {
+	config := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if configOnlyOnCommandLine[f.Name] {
+			return
+		}
+		if g, ok := f.Value.(flag.Getter); ok {
+			config[f.Name] = g.Get()
+			if d, ok := g.Get().(time.Duration); ok {
+				config[f.Name] = d.String()
+			}
+		} else {
+			config[f.Name] = f.Value.String()
+		}
+	})
+	if adminToken != "" {
+		config["admin-token"] = redacted
+	}
+	if runBookDefaults != nil {
+		config["defaults"] = redactSettings(runBookDefaults)
+	}
+	return config
+}
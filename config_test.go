@@ -0,0 +1,172 @@
+package main
+
+import (
+  "flag"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+// parseCommandLine swaps flag.CommandLine for a fresh set of the same flags
+// parsed from args, so that loadConfig sees only those as given. It returns a
+// func that puts the global set back.
+func parseCommandLine(t *testing.T, args ...string) func() {
+  orig := flag.CommandLine
+  fs := flag.NewFlagSet("captainhook", flag.ContinueOnError)
+  orig.VisitAll(func(f *flag.Flag) {
+    fs.Var(f.Value, f.Name, f.Usage)
+  })
+  if err := fs.Parse(args); err != nil {
+    t.Fatal(err)
+  }
+  flag.CommandLine = fs
+  return func() { flag.CommandLine = orig }
+}
+
+func TestLoadConfig(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  oldRateLimitBy, oldMaxBodyBytes := rateLimitBy, maxBodyBytes
+  defer func() {
+    rateLimitBy, maxBodyBytes, runBookDefaults = oldRateLimitBy, oldMaxBodyBytes, nil
+  }()
+
+  config := `
+rate-limit-by: client
+max-body-bytes: 1048576
+defaults:
+  timeout: 5m
+  env:
+    STAGE: prod
+    TEAM: none
+`
+  path := filepath.Join(dir, "captainhook.yaml")
+  ioutil.WriteFile(path, []byte(config), 0644)
+  restore := parseCommandLine(t)
+  err = loadConfig(path)
+  restore()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if rateLimitBy != "client" || maxBodyBytes != 1<<20 {
+    t.Errorf("flags were not set from the config: %q %d", rateLimitBy, maxBodyBytes)
+  }
+
+  // Flags given on the command line win.
+  rateLimitBy = limitByHookClient
+  ioutil.WriteFile(path, []byte("rate-limit-by: hook\nmax-body-bytes: 2048\n"), 0644)
+  restore = parseCommandLine(t, "-rate-limit-by=client")
+  err = loadConfig(path)
+  restore()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if rateLimitBy != "client" {
+    t.Errorf("config overrode a flag that was set: %q", rateLimitBy)
+  }
+  if maxBodyBytes != 2048 {
+    t.Errorf("config did not set a flag that was not given: %d", maxBodyBytes)
+  }
+
+  configdir = dir
+  ioutil.WriteFile(filepath.Join(dir, "_defaults.json"), []byte(`{"env": {"TEAM": "ops"}}`), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "hook.json"), []byte(`{"timeout": "1m", "scripts": []}`), 0644)
+  rb, err := getRunBookById("hook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if rb.Env["STAGE"] != "prod" || rb.Env["TEAM"] != "ops" || time.Duration(rb.Timeout) != time.Minute {
+    t.Errorf("unexpected runbook settings: env %v, timeout %v", rb.Env, time.Duration(rb.Timeout))
+  }
+
+  tests := []struct {
+    config string
+    err    string
+  }{
+    {"listen-adr: :8080\n", "unknown setting 'listen-adr'"},
+    {"version: true\n", "unknown setting 'version'"},
+    {"workers: lots\n", "workers"},
+    {"defaults: [1]\n", "defaults must be a mapping"},
+    {"defaults:\n  rateLimit:\n    rate: often\n", "defaults"},
+  }
+  defer parseCommandLine(t)()
+  for _, tt := range tests {
+    ioutil.WriteFile(path, []byte(tt.config), 0644)
+    if err := loadConfig(path); err == nil || !strings.Contains(err.Error(), tt.err) {
+      t.Errorf("config %q: wanted an error about %s, got %v", tt.config, tt.err, err)
+    }
+  }
+
+  runBookDefaults = map[string]interface{}{"auth": map[string]interface{}{"token": "abc123"}}
+  printed := effectiveConfig()
+  if auth := printed["defaults"].(map[string]interface{})["auth"].(map[string]interface{}); auth["token"] != redacted {
+    t.Errorf("default token was not redacted: %v", auth)
+  }
+  // A plain string is a token too, however short.
+  runBookDefaults = map[string]interface{}{"auth": "abc"}
+  printed = effectiveConfig()
+  if auth := printed["defaults"].(map[string]interface{})["auth"]; auth != redacted {
+    t.Errorf("default auth token was not redacted: %v", auth)
+  }
+}
+
+func TestRunBookTimeout(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  rb := &runBook{
+    ID:      "slow",
+    Timeout: duration(100 * time.Millisecond),
+    Scripts: []script{{Command: "sleep", Args: []string{"5"}}, {Command: "echo", Args: []string{"never"}}},
+  }
+  start := time.Now()
+  resp, err := rb.execute(input{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if time.Since(start) > 3*time.Second {
+    t.Errorf("runbook was not stopped at its timeout")
+  }
+  for i, res := range resp.Results {
+    if res.StatusCode != -1 || !strings.Contains(res.Stderr, "timed out") {
+      t.Errorf("script %d: wanted a timeout, got %+v", i, res)
+    }
+  }
+
+  // What the script started is stopped with it.
+  rb.Scripts = []script{{Command: "sh", Args: []string{"-c", "sleep 5; echo done"}}}
+  start = time.Now()
+  if resp, err = rb.execute(input{}); err != nil {
+    t.Fatal(err)
+  }
+  if took := time.Since(start); took > 2*time.Second {
+    t.Errorf("runbook run through a shell was stopped after %v", took)
+  }
+  if res := resp.Results[0]; res.StatusCode != -1 || strings.Contains(res.Stdout, "done") {
+    t.Errorf("wanted a timeout, got %+v", res)
+  }
+}
+
+func TestConfigFreeCommands(t *testing.T) {
+  tests := map[string]bool{
+    "config":       true,
+    "schema":       true,
+    "verify-audit": true,
+    "replay":       false,
+    "run":          false,
+  }
+  for command, want := range tests {
+    if got := configFree(command); got != want {
+      t.Errorf("%s: wanted configFree %v, got %v", command, want, got)
+    }
+  }
+}
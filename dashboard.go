@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+)
+
+// dashboardPolicy keeps the dashboard from loading anything but itself and
+// the admin api.
+const dashboardPolicy = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; frame-ancestors 'none'"
+
+// dashboardHandler serves the admin dashboard, a single page that shows the
+// hooks and recent jobs from the admin api.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", dashboardPolicy)
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>captainhook</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; font-size: 0.9em; }
+tr.job { cursor: pointer; }
+tr.job:hover { background: #f4f4f4; }
+.succeeded, .enabled { color: #18794e; }
+.failed, .interrupted, .error, .disabled { color: #c62828; }
+.queued, .running { color: #a15c00; }
+pre { background: #f4f4f4; padding: 0.6em; white-space: pre-wrap; max-height: 20em; overflow: auto; }
+button { font-size: 0.85em; }
+#status { color: #888; font-size: 0.8em; }
+</style>
+</head>
+<body>
+<h1>captainhook</h1>
+<div id="status"></div>
+
+<h2>Hooks</h2>
+<table>
+<thead><tr><th>Hook</th><th>Path</th><th>Methods</th><th>Schedule</th><th>State</th><th>Last run</th></tr></thead>
+<tbody id="hooks"></tbody>
+</table>
+
+<h2>Recent jobs</h2>
+<table>
+<thead><tr><th>Job</th><th>Hook</th><th>State</th><th>Created</th><th>Duration</th><th></th></tr></thead>
+<tbody id="jobs"></tbody>
+</table>
+
+<div id="job"></div>
+
+<script>
+"use strict";
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined && text !== null) e.textContent = text;
+  if (cls) e.className = cls;
+  return e;
+}
+
+function row(cells) {
+  var tr = el("tr");
+  cells.forEach(function (c) {
+    var td = el("td");
+    if (c instanceof Node) td.appendChild(c); else td.textContent = c === undefined ? "" : c;
+    tr.appendChild(td);
+  });
+  return tr;
+}
+
+function duration(j) {
+  if (!j.started) return "";
+  var end = j.finished ? new Date(j.finished) : new Date();
+  return ((end - new Date(j.started)) / 1000).toFixed(1) + "s";
+}
+
+function when(t) {
+  return t ? new Date(t).toLocaleString() : "";
+}
+
+function get(path) {
+  return fetch(path, {credentials: "same-origin"}).then(function (r) {
+    if (!r.ok) throw new Error(path + ": " + r.status);
+    return r.json();
+  });
+}
+
+function rerun(id) {
+  if (!confirm("Run job " + id + " again with the same input?")) return;
+  fetch("jobs/" + encodeURIComponent(id) + "/replay", {method: "POST", credentials: "same-origin"})
+    .then(function (r) { return r.ok ? r.json() : r.text().then(function (t) { throw new Error(t); }); })
+    .then(function (j) { refresh(); show(j.id); })
+    .catch(function (e) { alert(e.message); });
+}
+
+function show(id) {
+  get("jobs/" + encodeURIComponent(id)).then(function (j) {
+    var box = document.getElementById("job");
+    box.textContent = "";
+    box.appendChild(el("h2", "Job " + j.id + " (" + j.hook + ")"));
+    box.appendChild(el("p", j.state + (j.error ? ": " + j.error : ""), j.state));
+    ((j.response && j.response.results) || []).forEach(function (res, i) {
+      box.appendChild(el("h3", "Script " + (i + 1) + ", exit status " + res.status_code));
+      box.appendChild(el("div", "stdout"));
+      box.appendChild(el("pre", res.stdout));
+      box.appendChild(el("div", "stderr"));
+      box.appendChild(el("pre", res.stderr));
+    });
+  }).catch(function (e) { alert(e.message); });
+}
+
+function refresh() {
+  get("hooks").then(function (hooks) {
+    var body = document.getElementById("hooks");
+    body.textContent = "";
+    hooks.forEach(function (h) {
+      var state = h.error ? el("span", "error: " + h.error, "error")
+        : el("span", h.enabled ? "enabled" : "disabled", h.enabled ? "enabled" : "disabled");
+      var last = h.lastRun ? el("span", h.lastRun.state + ", " + when(h.lastRun.created), h.lastRun.state) : "";
+      body.appendChild(row([h.id, h.path, (h.methods || []).join(", "), h.schedule, state, last]));
+    });
+  }).catch(status);
+
+  get("jobs?limit=50").then(function (jobs) {
+    var body = document.getElementById("jobs");
+    body.textContent = "";
+    jobs.forEach(function (j) {
+      var button = el("button", "Re-run");
+      button.onclick = function (ev) { ev.stopPropagation(); rerun(j.id); };
+      var tr = row([j.id, j.hook, el("span", j.state, j.state), when(j.created), duration(j), button]);
+      tr.className = "job";
+      tr.onclick = function () { show(j.id); };
+      body.appendChild(tr);
+    });
+    status();
+  }).catch(status);
+}
+
+function status(err) {
+  document.getElementById("status").textContent = err ? "Update failed: " + err.message : "Updated " + new Date().toLocaleTimeString();
+}
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
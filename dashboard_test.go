@@ -0,0 +1,129 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestDashboard(t *testing.T) {
+  adminToken = "admin"
+  defer func() { adminToken = "" }()
+  admin := httptest.NewServer(adminRouter())
+  defer admin.Close()
+
+  resp, _ := http.Get(admin.URL + "/")
+  if resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") == "" {
+    t.Errorf("wanted a basic auth challenge, got %d", resp.StatusCode)
+  }
+
+  status, data := adminRequest(t, "GET", admin.URL+"/")
+  if status != 200 || !strings.Contains(string(data), "<title>captainhook</title>") {
+    t.Fatalf("dashboard: %d", status)
+  }
+  if external := regexp.MustCompile(`(?i)(src|href)\s*=\s*"?(https?:)?//`).FindString(string(data)); external != "" {
+    t.Errorf("dashboard loads an external asset: %s", external)
+  }
+}
+
+func TestAdminJobs(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  adminToken = "admin"
+  defer func() { adminToken = "" }()
+  ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"scripts": [{"command": "echo", "args": ["a"]}]}`), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"scripts": [{"command": "echo", "args": ["b"]}]}`), 0644)
+  if queue, err = newJobQueue(filepath.Join(dir, "jobs"), 1); err != nil {
+    t.Fatal(err)
+  }
+  defer queue.stop()
+
+  // Finished jobs are only on disk.
+  var ids []string
+  for _, hook := range []string{"a", "b", "a"} {
+    rb, _ := NewRunBook(hook)
+    j, err := queue.create(rb, input{}, "", false)
+    if err != nil {
+      t.Fatal(err)
+    }
+    queue.run(j)
+    ids = append(ids, j.ID)
+    time.Sleep(1100 * time.Millisecond)
+  }
+
+  admin := httptest.NewServer(adminRouter())
+  defer admin.Close()
+
+  tests := []struct {
+    query string
+    ids   []string
+  }{
+    {"", []string{ids[2], ids[1], ids[0]}},
+    {"?hook=a", []string{ids[2], ids[0]}},
+    {"?limit=1", []string{ids[2]}},
+    {"?hook=none", []string{}},
+  }
+  for _, tt := range tests {
+    status, data := adminRequest(t, "GET", admin.URL+"/jobs"+tt.query)
+    var jobs []jobStatus
+    if err := json.Unmarshal(data, &jobs); status != 200 || err != nil {
+      t.Fatalf("%s: %d %s", tt.query, status, data)
+    }
+    got := make([]string, len(jobs))
+    for i, j := range jobs {
+      got[i] = j.ID
+      if j.State != jobSucceeded || j.Response != nil {
+        t.Errorf("%s: unexpected job %+v", tt.query, j)
+      }
+    }
+    if strings.Join(got, " ") != strings.Join(tt.ids, " ") {
+      t.Errorf("%s: wanted %v, got %v", tt.query, tt.ids, got)
+    }
+  }
+  if status, _ := adminRequest(t, "GET", admin.URL+"/jobs?limit=0"); status != 400 {
+    t.Errorf("wanted 400 for limit=0, got %d", status)
+  }
+
+  // Re-run from the dashboard, but not from another site.
+  req, _ := http.NewRequest("POST", admin.URL+"/jobs/"+ids[1]+"/replay", nil)
+  req.SetBasicAuth("", "admin")
+  req.Header.Set("Origin", "https://evil.example.com")
+  resp, _ := http.DefaultClient.Do(req)
+  if resp.StatusCode != http.StatusForbidden {
+    t.Errorf("wanted 403 for a cross-origin replay, got %d", resp.StatusCode)
+  }
+  req, _ = http.NewRequest("POST", admin.URL+"/jobs/"+ids[1]+"/replay", nil)
+  req.SetBasicAuth("", "admin")
+  req.Header.Set("Origin", admin.URL)
+  resp, _ = http.DefaultClient.Do(req)
+  if resp.StatusCode != http.StatusAccepted {
+    t.Fatalf("wanted 202 for a replay, got %d", resp.StatusCode)
+  }
+  var queued map[string]string
+  json.NewDecoder(resp.Body).Decode(&queued)
+  resp.Body.Close()
+  var job jobStatus
+  for i := 0; i < 100 && job.State != jobSucceeded; i++ {
+    time.Sleep(10 * time.Millisecond)
+    _, data := adminRequest(t, "GET", admin.URL+"/jobs/"+queued["id"])
+    json.Unmarshal(data, &job)
+  }
+  if job.ReplayOf != ids[1] || job.Response == nil || job.Response.Results[0].Stdout != "b\n" {
+    t.Errorf("unexpected replay: %+v", job)
+  }
+}
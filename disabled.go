@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// disabledHooks are the hooks switched off through the admin api, with when
+// they were. With a file they are kept across restarts.
+type disabledHooks struct {
+	mu   sync.RWMutex
+	file string
+	ids  map[string]time.Time
+}
+
+// disabled is in memory only unless there is a datadir.
+var disabled = &disabledHooks{ids: make(map[string]time.Time)}
+
+func newDisabledHooks(file string) (*disabledHooks, error) {
+	d := &disabledHooks{file: file, ids: make(map[string]time.Time)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &d.ids); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// since returns when id was disabled, or the zero time if it is enabled.
+func (d *disabledHooks) since(id string) time.Time {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.ids[id]
+}
+
+func (d *disabledHooks) has(id string) bool {
+	return !d.since(id).IsZero()
+}
+
+// set disables or enables id and saves the change.
+func (d *disabledHooks) set(id string, off bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, was := d.ids[id]
+	if was == off {
+		return nil
+	}
+	ids := make(map[string]time.Time, len(d.ids)+1)
+	for k, v := range d.ids {
+		ids[k] = v
+	}
+	if off {
+		ids[id] = time.Now().UTC()
+	} else {
+		delete(ids, id)
+	}
+	if err := d.save(ids); err != nil {
+		return err
+	}
+	d.ids = ids
+	return nil
+}
+
+func (d *disabledHooks) save(ids map[string]time.Time) error {
+	if d.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(d.file), ".tmp-disabled")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), d.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(d.file))
+}
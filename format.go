@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// runBookExtensions are the formats runbooks can be written in, in the order
+// they are looked for.
+var runBookExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+func isRunBookFile(path string) bool {
+	ext := filepath.Ext(path)
+	for _, e := range runBookExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSettings decodes a runbook or defaults file into a map, according
+// to the extension of path.
+func decodeSettings(path string, data []byte) (map[string]interface{}, error) {
+	settings := make(map[string]interface{})
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return settings, nil
+		}
+		m, ok := stringKeys(v).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("top level must be a mapping")
+		}
+		return m, nil
+	case ".toml":
+		if _, err := toml.Decode(string(data), &settings); err != nil {
+			return nil, err
+		}
+		return settings, nil
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// stringKeys turns the map[interface{}]interface{} values YAML decodes
+// into maps with string keys, which encoding/json can handle.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[fmt.Sprint(k)] = stringKeys(x)
+		}
+		return m
+	case []interface{}:
+		for i, x := range v {
+			v[i] = stringKeys(x)
+		}
+	}
+	return v
+}
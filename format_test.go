@@ -0,0 +1,122 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+var formatRunBooks = map[string]string{
+  "hook.json": `{
+  "allowedNetworks": ["10.0.0.0/8", "::1/128"],
+  "auth": {"name": "ci", "token": "s3cret", "notBefore": "2015-06-01T00:00:00Z"},
+  "env": {"STAGE": "prod"},
+  "rateLimit": {"rate": "10/1m"},
+  "scripts": [{"command": "deploy.sh", "args": ["--repo", "{{.Hook}}"], "env": {"DEBUG": "1"}}]
+}`,
+  "hook.yaml": `
+allowedNetworks: [10.0.0.0/8, "::1/128"]
+auth:
+  name: ci
+  token: s3cret
+  notBefore: 2015-06-01T00:00:00Z
+env:
+  STAGE: prod
+rateLimit:
+  rate: 10/1m
+scripts:
+  - command: deploy.sh
+    args: [--repo, "{{.Hook}}"]
+    env:
+      DEBUG: "1"
+`,
+  "hook.toml": `
+allowedNetworks = ["10.0.0.0/8", "::1/128"]
+
+[auth]
+name = "ci"
+token = "s3cret"
+notBefore = 2015-06-01T00:00:00Z
+
+[env]
+STAGE = "prod"
+
+[rateLimit]
+rate = "10/1m"
+
+[[scripts]]
+command = "deploy.sh"
+args = ["--repo", "{{.Hook}}"]
+env = { DEBUG = "1" }
+`,
+}
+
+func TestRunBookFormats(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+
+  var want *runBook
+  for _, name := range []string{"hook.json", "hook.yaml", "hook.toml"} {
+    path := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(path, []byte(formatRunBooks[name]), 0644); err != nil {
+      t.Fatal(err)
+    }
+    rb, err := getRunBookById("hook")
+    os.Remove(path)
+    if err != nil {
+      t.Errorf("%s: %v", name, err)
+      continue
+    }
+    if len(rb.AllowedNetworks.Networks) != 2 || len(rb.Auth) != 1 || rb.Auth[0].NotBefore == nil {
+      t.Errorf("%s: unexpected runbook %+v", name, rb)
+      continue
+    }
+    if !rb.Auth[0].NotBefore.Equal(time.Date(2015, time.June, 1, 0, 0, 0, 0, time.UTC)) {
+      t.Errorf("%s: wrong notBefore %v", name, rb.Auth[0].NotBefore)
+    }
+    // Times compare by location too.
+    rb.Auth[0].NotBefore = nil
+    if want == nil {
+      want = rb
+    } else if !reflect.DeepEqual(rb, want) {
+      t.Errorf("%s: wanted %+v, got %+v", name, want, rb)
+    }
+  }
+
+  ioutil.WriteFile(filepath.Join(dir, "twice.json"), []byte(`{"scripts": []}`), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "twice.yml"), []byte(`scripts: []`), 0644)
+  if _, err := getRunBookById("twice"); err == nil || !strings.Contains(err.Error(), "twice.json and twice.yml") {
+    t.Errorf("wanted an error naming both files, got %v", err)
+  }
+  ids, _ := listRunBooks()
+  if !reflect.DeepEqual(ids, []string{"twice"}) {
+    t.Errorf("wanted runbooks [twice], got %v", ids)
+  }
+
+  ioutil.WriteFile(filepath.Join(dir, "_defaults.yaml"), []byte("env:\n  TEAM: ops\n"), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "inherits.toml"), []byte("[[scripts]]\ncommand = \"true\"\n"), 0644)
+  rb, err := getRunBookById("inherits")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if rb.Env["TEAM"] != "ops" {
+    t.Errorf("YAML defaults were not inherited by a TOML runbook: %v", rb.Env)
+  }
+
+  ioutil.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("scripts: [\n"), 0644)
+  if _, err := getRunBookById("broken"); err == nil || !strings.Contains(err.Error(), "broken.yaml") {
+    t.Errorf("wanted an error naming broken.yaml, got %v", err)
+  }
+}
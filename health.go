@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// shutdownTimeout bounds how long a draining server waits for requests in
+// flight.
+const shutdownTimeout = 30 * time.Second
+
+var (
+	// ready is set once the config is loaded and the job queue recovered.
+	ready int32
+	// draining is set when captainhook has been asked to stop.
+	draining int32
+)
+
+// probePaths returns the paths of the probe endpoints that are enabled.
+func probePaths() []string {
+	var paths []string
+	for _, p := range []string{healthPath, readyPath, versionPath} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// reserveProbePaths checks the probe paths and reserves their first segments
+// so that no hook can be served there.
+func reserveProbePaths() error {
+	seen := make(map[string]bool)
+	for _, p := range probePaths() {
+		if !strings.HasPrefix(p, "/") || len(p) < 2 {
+			return fmt.Errorf("probe path '%s' must start with / and name something", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("probe path '%s' is given twice", p)
+		}
+		seen[p] = true
+		first := strings.SplitN(p[1:], "/", 2)[0]
+		if first == "jobs" {
+			return fmt.Errorf("probe path '%s' is reserved", p)
+		}
+		reservedHookNamespaces[first] = true
+	}
+	return nil
+}
+
+// checkProbeCollisions fails if a runbook in the configdir has its id in the
+// namespace of a probe path, where it could no longer be called. It must run
+// before reserveProbePaths, as runbooks in reserved namespaces are not listed.
+func checkProbeCollisions() error {
+	namespaces := make(map[string]string)
+	for _, p := range probePaths() {
+		namespaces[strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]] = p
+	}
+	ids, err := listRunBooks()
+	if err != nil {
+		log.WithField("error", err).Error("Failed to list runbooks!")
+		return nil
+	}
+	for _, id := range ids {
+		if p, ok := namespaces[strings.SplitN(id, "/", 2)[0]]; ok {
+			return fmt.Errorf("hook '%s' collides with probe path '%s', rename it or move the probe", id, p)
+		}
+	}
+	return nil
+}
+
+// healthHandler answers as long as the process is alive.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// readyHandler answers 200 if captainhook can take hooks: its config is
+// loaded, its job queue can be written to and it is not draining.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"config":   "ok",
+		"queue":    "ok",
+		"draining": "no",
+	}
+	ok := true
+	if atomic.LoadInt32(&ready) == 0 {
+		checks["config"] = "not loaded"
+		ok = false
+	}
+	if queue == nil {
+		checks["queue"] = "not started"
+		ok = false
+	} else if err := queue.writable(); err != nil {
+		checks["queue"] = err.Error()
+		ok = false
+	}
+	if atomic.LoadInt32(&draining) != 0 {
+		checks["draining"] = "yes"
+		ok = false
+	}
+	status := map[string]interface{}{"status": "ok", "checks": checks}
+	code := http.StatusOK
+	if !ok {
+		status["status"] = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// versionInfo is what /version answers with.
+type versionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func buildVersion() versionInfo {
+	v := versionInfo{Version: Version, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.time":
+			v.BuildTime = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, buildVersion())
+}
+
+// writable reports whether jobs can be saved.
+func (q *jobQueue) writable() error {
+	if q.dir == "" {
+		return nil
+	}
+	f, err := ioutil.TempFile(q.dir, ".tmp-ready")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// drainOnSignal stops servers gracefully on SIGTERM or an interrupt.
+// Readiness fails and the scheduler stops from then on and, on SIGTERM,
+// requests are still served for drainDelay so that load balancers can
+// notice. Requests in flight, scheduled runs and queued jobs are then given
+// shutdownTimeout to finish. The returned channel
+// is closed once the servers have stopped.
+func drainOnSignal(servers ...*http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		s := <-sig
+		atomic.StoreInt32(&draining, 1)
+		// Scheduled runs would keep the queue from ever draining.
+		if sched != nil {
+			sched.stop()
+		}
+		// Nothing routes traffic by readiness to a process stopped from
+		// its terminal.
+		delay := drainDelay
+		if s == os.Interrupt {
+			delay = 0
+		}
+		log.WithFields(log.Fields{
+			"signal": s,
+			"delay":  delay,
+		}).Info("Draining, no longer ready.")
+		time.Sleep(delay)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				log.WithFields(log.Fields{
+					"listen": server.Addr,
+					"error":  err,
+				}).Error("Requests were still running at shutdown!")
+			}
+		}
+		if sched != nil {
+			if err := sched.waitIdle(ctx); err != nil {
+				log.WithField("error", err).Error("Scheduled runs were still running at shutdown!")
+			}
+		}
+		if queue != nil {
+			if err := queue.waitIdle(ctx); err != nil {
+				log.WithField("error", err).Error("Jobs were still running at shutdown!")
+			}
+		}
+		close(done)
+	}()
+	return done
+}
+
+// idle reports whether q has no queued or running jobs.
+func (q *jobQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if !j.done() {
+			return false
+		}
+	}
+	return true
+}
+
+// waitIdle waits until q has no queued or running jobs, or ctx is done.
+func (q *jobQueue) waitIdle(ctx context.Context) error {
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for !q.idle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync/atomic"
+  "syscall"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestReserveProbePaths(t *testing.T) {
+  defer func(h, r, v string) { healthPath, readyPath, versionPath = h, r, v }(healthPath, readyPath, versionPath)
+  defer func() {
+    for ns := range reservedHookNamespaces {
+      if ns != "jobs" {
+        delete(reservedHookNamespaces, ns)
+      }
+    }
+  }()
+
+  tests := []struct {
+    health, ready, version string
+    err                    string
+  }{
+    {"/healthz", "/readyz", "/version", ""},
+    {"/_/live", "", "/_/version", ""},
+    {"healthz", "/readyz", "/version", "must start with /"},
+    {"/", "/readyz", "/version", "must start with /"},
+    {"/probe", "/probe", "", "given twice"},
+    {"/jobs/health", "", "", "reserved"},
+  }
+  for _, tt := range tests {
+    healthPath, readyPath, versionPath = tt.health, tt.ready, tt.version
+    err := reserveProbePaths()
+    if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+      t.Errorf("%q %q %q: wanted error %q, got %v", tt.health, tt.ready, tt.version, tt.err, err)
+    }
+  }
+  if err := validateHookID("healthz"); err == nil {
+    t.Error("hook id healthz was not reserved")
+  }
+  if err := validateHookID("_/live"); err == nil {
+    t.Error("hook id _/live was accepted")
+  }
+}
+
+func TestProbeCollisions(t *testing.T) {
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  ioutil.WriteFile(filepath.Join(dir, "deploy.json"), []byte(`{"scripts": []}`), 0644)
+  if err := checkProbeCollisions(); err != nil {
+    t.Errorf("unexpected collision: %v", err)
+  }
+  os.Mkdir(filepath.Join(dir, "readyz"), 0755)
+  ioutil.WriteFile(filepath.Join(dir, "readyz", "check.json"), []byte(`{"scripts": []}`), 0644)
+  if err := checkProbeCollisions(); err == nil || !strings.Contains(err.Error(), "readyz/check") {
+    t.Errorf("wanted a collision with readyz/check, got %v", err)
+  }
+}
+
+func TestDrainOnInterrupt(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+  defer func(d time.Duration) { drainDelay = d }(drainDelay)
+  defer atomic.StoreInt32(&draining, 0)
+  drainDelay = time.Minute
+
+  var err error
+  if queue, err = newJobQueue("", 1); err != nil {
+    t.Fatal(err)
+  }
+  defer queue.stop()
+  rb := &runBook{ID: "slow", Scripts: []script{{Command: "sleep", Args: []string{"0.3"}}}}
+  j, err := queue.submit(rb, input{})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // Both the hook and the admin listener are shut down.
+  var servers []*http.Server
+  var addrs []string
+  for i := 0; i < 2; i++ {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+      t.Fatal(err)
+    }
+    s := &http.Server{Handler: http.NotFoundHandler()}
+    go s.Serve(ln)
+    servers = append(servers, s)
+    addrs = append(addrs, ln.Addr().String())
+  }
+
+  start := time.Now()
+  done := drainOnSignal(servers...)
+  syscall.Kill(os.Getpid(), syscall.SIGINT)
+  select {
+  case <-done:
+  case <-time.After(10 * time.Second):
+    t.Fatal("server did not stop")
+  }
+  for _, addr := range addrs {
+    if conn, err := net.Dial("tcp", addr); err == nil {
+      conn.Close()
+      t.Errorf("%s still accepts connections after the drain", addr)
+    }
+  }
+  if took := time.Since(start); took >= drainDelay {
+    t.Errorf("interrupt waited for the drain delay: %v", took)
+  }
+  if got, _ := queue.get(j.ID); got.State != jobSucceeded {
+    t.Errorf("job was not drained: %s", got.State)
+  }
+}
+
+func TestProbes(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  if queue, err = newJobQueue(filepath.Join(dir, "jobs"), 0); err != nil {
+    t.Fatal(err)
+  }
+  defer atomic.StoreInt32(&ready, 0)
+  defer atomic.StoreInt32(&draining, 0)
+
+  ts := httptest.NewServer(newRouter(nil))
+  defer ts.Close()
+
+  get := func(path string) (int, map[string]interface{}) {
+    resp, err := http.Get(ts.URL + path)
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    var body map[string]interface{}
+    json.NewDecoder(resp.Body).Decode(&body)
+    return resp.StatusCode, body
+  }
+
+  if status, body := get("/healthz"); status != 200 || body["status"] != "ok" {
+    t.Errorf("healthz: %d %v", status, body)
+  }
+  if status, body := get("/version"); status != 200 || body["version"] != Version || body["goVersion"] == "" {
+    t.Errorf("version: %d %v", status, body)
+  }
+
+  tests := []struct {
+    ready, draining int32
+    readOnly        bool
+    status          int
+    failing         string
+  }{
+    {0, 0, false, 503, "config"},
+    {1, 0, false, 200, ""},
+    {1, 1, false, 503, "draining"},
+    {1, 0, true, 503, "queue"},
+  }
+  for _, tt := range tests {
+    atomic.StoreInt32(&ready, tt.ready)
+    atomic.StoreInt32(&draining, tt.draining)
+    if tt.readOnly {
+      os.Chmod(filepath.Join(dir, "jobs"), 0500)
+    }
+    status, body := get("/readyz")
+    os.Chmod(filepath.Join(dir, "jobs"), 0700)
+    if tt.readOnly && os.Getuid() == 0 {
+      // Permissions do not stop root.
+      continue
+    }
+    if status != tt.status {
+      t.Errorf("%+v: wanted %d, got %d: %v", tt, tt.status, status, body)
+    }
+    checks, _ := body["checks"].(map[string]interface{})
+    for name, v := range checks {
+      failing := v != "ok" && v != "no"
+      if failing != (name == tt.failing) {
+        t.Errorf("%+v: unexpected check %s: %v", tt, name, v)
+      }
+    }
+  }
+}
+
+func TestDrainStopsScheduler(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+  defer func(d time.Duration) { drainDelay = d }(drainDelay)
+  defer atomic.StoreInt32(&draining, 0)
+  defer func(s *scheduler) { sched = s }(sched)
+  drainDelay = 0
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  script := `{"schedule": "@every 1s", "scripts": [{"command": "echo", "args": ["tick"]}]}`
+  if err := ioutil.WriteFile(filepath.Join(dir, "tick.json"), []byte(script), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if queue, err = newJobQueue("", 1); err != nil {
+    t.Fatal(err)
+  }
+  defer queue.stop()
+  jobs := func() int {
+    queue.mu.Lock()
+    defer queue.mu.Unlock()
+    return len(queue.jobs)
+  }
+
+  sched = newScheduler(queue)
+  go sched.run()
+  // Drain once the first run has been fired, so the next one is due within
+  // a second.
+  for i := 0; jobs() == 0; i++ {
+    if i == 100 {
+      t.Fatal("schedule did not fire")
+    }
+    time.Sleep(20 * time.Millisecond)
+  }
+  done := drainOnSignal()
+  syscall.Kill(os.Getpid(), syscall.SIGTERM)
+  select {
+  case <-done:
+  case <-time.After(10 * time.Second):
+    t.Fatal("drain did not finish")
+  }
+  if !queue.idle() {
+    t.Error("jobs were still running after the drain")
+  }
+  n := jobs()
+  time.Sleep(1500 * time.Millisecond)
+  if got := jobs(); got != n {
+    t.Errorf("scheduler fired %d runs after the drain", got-n)
+  }
+}
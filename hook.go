@@ -3,45 +3,150 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"io"
-	"io/ioutil"
-	"net"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/gorilla/mux"
 )
 
+// input is what a hook invocation hands to its scripts. Headers and Body are
+// recorded with the job so that a delivery can be replayed.
 type input struct {
-	Stdin []byte
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+	Claims  map[string]string `json:"claims,omitempty"`
+	Params  map[string]string `json:"params,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+	Stdin   []byte            `json:"stdin"`
 }
 
-func gatherInput(r *http.Request) (i input, err error) {
+// dryRunResponse describes what a hook would run.
+type dryRunResponse struct {
+	Hook    string           `json:"hook"`
+	Async   bool             `json:"async"`
+	Scripts []resolvedScript `json:"scripts"`
+}
+
+// ownQueryParams are query parameters meant for captainhook rather than the
+// hook's scripts.
+var ownQueryParams = map[string]bool{
+	"dryRun": true,
+}
+
+// gatherInput reads the request into what scripts are handed. The raw body,
+// as it was sent, is returned for signature checks.
+func gatherInput(r *http.Request, limit int64) (i input, raw []byte, err error) {
 	headers := make(map[string]string, len(r.Header))
 	for k := range r.Header {
 		headers[k] = r.Header.Get(k)
 	}
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil && err != io.EOF {
+	raw, err = readBody(r, limit)
+	if err != nil {
+		return
+	}
+	body, err := decodeBody(r.Header, raw, limit)
+	if err != nil {
 		return
 	}
 	h, err := json.Marshal(headers)
 	if err != nil {
 		return
 	}
+	i.Headers = headers
+	i.Body = body
+	for k := range r.URL.Query() {
+		if ownQueryParams[k] {
+			continue
+		}
+		if i.Query == nil {
+			i.Query = make(map[string]string)
+		}
+		i.Query[k] = r.URL.Query().Get(k)
+	}
 	i.Stdin = bytes.Join([][]byte{h, body}, []byte("\n"))
 	return
 }
 
+// credentialHeaders carry credentials and are not stored with a job.
+var credentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	defaultTokenHeader,
+	adminTokenHeader,
+}
+
+// scrubbed returns a copy of i for storing, with the values of headers that
+// carry credentials, including those rb reads its tokens from, redacted. A
+// job resumed after a restart or replayed sees them redacted too.
+func (i input) scrubbed(rb *runBook) input {
+	names := append([]string(nil), credentialHeaders...)
+	if rb != nil {
+		for _, c := range rb.Auth {
+			if c.Scheme == schemeHeader && c.Header != "" {
+				names = append(names, c.Header)
+			}
+		}
+	}
+	headers := make(map[string]string, len(i.Headers))
+	scrubbed := false
+	for k, v := range i.Headers {
+		for _, name := range names {
+			if strings.EqualFold(k, name) {
+				v = redacted
+				scrubbed = true
+			}
+		}
+		headers[k] = v
+	}
+	if !scrubbed {
+		return i
+	}
+	i.Headers = headers
+	// Scripts get the headers as the first line of their input.
+	if n := bytes.IndexByte(i.Stdin, '\n'); n >= 0 && json.Unmarshal(i.Stdin[:n], new(map[string]string)) == nil {
+		if h, err := json.Marshal(headers); err == nil {
+			i.Stdin = append(h, i.Stdin[n:]...)
+		}
+	}
+	return i
+}
+
+// hookHandler serves hooks at their ids.
 func hookHandler(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id := params["id"]
+	serveHook(w, r, mux.Vars(r)["id"], "", nil)
+}
+
+// pathHandler serves hook id at the path it declares, handing the path's
+// parameters to its scripts.
+func pathHandler(id, path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHook(w, r, id, path, mux.Vars(r))
+	}
+}
+
+// serveHook calls hook id, which was reached at path, or at its id if path
+// is empty.
+func serveHook(w http.ResponseWriter, r *http.Request, id, path string, params map[string]string) {
+	remoteIP := clientIP(r)
 	log.WithFields(log.Fields{
 		"hook":    id,
 		"address": r.RemoteAddr,
+		"client":  remoteIP,
 	}).Info("Recieved webhook.")
+	rec := &auditRecord{
+		Event:   auditRequest,
+		Hook:    id,
+		Client:  remoteIP.String(),
+		Address: r.RemoteAddr,
+		CertCN:  clientCertCN(r.TLS),
+	}
+	defer audit.write(rec)
 
 	rb, err := NewRunBook(id)
 	if err != nil {
@@ -49,37 +154,208 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 			"hook":  id,
 			"error": err,
 		}).Error("RunBook Error!")
+		rec.fail(err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	remoteIP := net.ParseIP(strings.Split(r.RemoteAddr, ":")[0])
-	if !rb.AddrIsAllowed(remoteIP) {
+	// The runbook may have moved since the routes were built.
+	if rb.Path != path {
+		log.WithFields(log.Fields{
+			"hook": id,
+			"path": rb.Path,
+		}).Warn("Hook called outside its path!")
+		rec.deny("not at the hook's path")
+		http.NotFound(w, r)
+		return
+	}
+	if disabled.has(id) {
+		log.WithFields(log.Fields{
+			"hook":    id,
+			"address": r.RemoteAddr,
+		}).Warn("Hook is disabled!")
+		rec.deny("hook disabled")
+		http.Error(w, "Hook is disabled.", http.StatusServiceUnavailable)
+		return
+	}
+	if !rb.MethodIsAllowed(r.Method) {
+		log.WithFields(log.Fields{
+			"hook":    id,
+			"address": r.RemoteAddr,
+			"method":  r.Method,
+		}).Warn("Method not allowed!")
+		rec.deny("method not allowed")
+		w.Header().Set("Allow", strings.Join(rb.allowedMethods(), ", "))
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	requestsByHook.Add(id, 1)
+	if l, scope := rateLimitFor(rb); l != nil {
+		if ok, wait := limiter.allow(l, l.key(scope, id, remoteIP.String()), time.Now()); !ok {
+			throttledByHook.Add(id, 1)
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			log.WithFields(log.Fields{
+				"hook":        id,
+				"address":     r.RemoteAddr,
+				"client":      remoteIP,
+				"retry_after": retryAfter,
+			}).Warn("Rate limit exceeded!")
+			rec.deny("rate limited")
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+			return
+		}
+	}
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			rec.deny("invalid dryRun value")
+			http.Error(w, "Invalid dryRun value.", http.StatusBadRequest)
+			return
+		}
+	}
+	if dryRun && !adminAuthorized(r) {
 		log.WithFields(log.Fields{
 			"hook":    id,
 			"address": r.RemoteAddr,
+		}).Warn("Dry run without admin token!")
+		rec.deny("dry run without admin token")
+		http.Error(w, "Not authorized.", http.StatusUnauthorized)
+		return
+	}
+	if !rb.AddrIsAllowed(remoteIP) || !rb.ClientCertIsAllowed(r.TLS) {
+		log.WithFields(log.Fields{
+			"hook":    id,
+			"address": r.RemoteAddr,
+			"client":  remoteIP,
 		}).Warn("Not Authorized!")
+		if rb.AddrIsAllowed(remoteIP) {
+			rec.deny("client certificate not allowed")
+		} else {
+			rec.deny("address not allowed")
+		}
 		http.Error(w, "Not authorized.", http.StatusUnauthorized)
 		return
 	}
-	if !rb.Authorized(r) {
+	credential, ok := rb.authenticate(r)
+	rec.Credential = credential
+	if !ok {
 		log.WithFields(log.Fields{
 			"hook":    id,
 			"address": r.RemoteAddr,
 		}).Warn("Authentication Failure!")
+		rec.deny("authentication failed")
+		http.Error(w, "Not authorized.", http.StatusUnauthorized)
+		return
+	}
+	claims, subject, err := rb.verifyJWT(r)
+	rec.Subject = subject
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":    id,
+			"address": r.RemoteAddr,
+			"error":   err,
+		}).Warn("JWT Verification Failure!")
+		rec.deny("jwt: " + err.Error())
 		http.Error(w, "Not authorized.", http.StatusUnauthorized)
 		return
 	}
 
+	if !rb.ContentTypeIsAllowed(r.Header.Get("Content-Type")) {
+		log.WithFields(log.Fields{
+			"hook":         id,
+			"address":      r.RemoteAddr,
+			"content_type": r.Header.Get("Content-Type"),
+		}).Warn("Content type not allowed!")
+		rec.deny("content type not allowed")
+		http.Error(w, "Unsupported content type.", http.StatusUnsupportedMediaType)
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"hook":    id,
 		"address": r.RemoteAddr,
 	}).Debug("Gathering request input.")
-	in, err := gatherInput(r)
+	in, raw, err := gatherInput(r, rb.bodyLimit())
+	if err == errBodyTooLarge {
+		log.WithFields(log.Fields{
+			"hook":    id,
+			"address": r.RemoteAddr,
+			"limit":   rb.bodyLimit(),
+		}).Warn("Request body too large!")
+		rec.deny("request body too large")
+		http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"hook":  id,
 			"error": err,
 		}).Error("Could not parse request!")
+		rec.deny("bad request: " + err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	in.Claims = claims
+	in.Params = params
+	rec.PayloadSHA256 = payloadHash(raw)
+	if rb.Signature != nil {
+		if err := rb.Signature.verify(r, raw, time.Now()); err != nil {
+			log.WithFields(log.Fields{
+				"hook":    id,
+				"address": r.RemoteAddr,
+				"error":   err,
+			}).Warn("Signature Verification Failure!")
+			rec.deny("signature: " + err.Error())
+			http.Error(w, "Not authorized.", http.StatusUnauthorized)
+			return
+		}
+	}
+	// Dry runs do not use up the delivery id.
+	if rb.Nonce != nil && !dryRun {
+		delivery := r.Header.Get(rb.Nonce.Header)
+		if delivery == "" {
+			log.WithFields(log.Fields{
+				"hook":    id,
+				"address": r.RemoteAddr,
+			}).Warn("Missing delivery id!")
+			rec.deny("missing delivery id")
+			http.Error(w, "Missing "+rb.Nonce.Header+" header.", http.StatusBadRequest)
+			return
+		}
+		if err := nonces.check(id, delivery, rb.Nonce.retention()); err != nil {
+			log.WithFields(log.Fields{
+				"hook":     id,
+				"address":  r.RemoteAddr,
+				"delivery": delivery,
+				"error":    err,
+			}).Warn("Duplicate delivery!")
+			rec.deny("duplicate delivery " + delivery)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	rec.Decision = auditAllowed
+	if dryRun {
+		rec.Outcome = "dry run"
+		plan, err := rb.plan(in)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"hook":  id,
+				"error": err,
+			}).Error("Could not render scripts!")
+			rec.fail(err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.WithFields(log.Fields{
+			"hook":        id,
+			"address":     r.RemoteAddr,
+			"num_scripts": len(rb.Scripts),
+		}).Info("Dry run, not executing hook scripts.")
+		rb.redactPlan(plan)
+		writeJSON(w, dryRunResponse{Hook: id, Async: rb.Async, Scripts: plan})
+		return
 	}
 
 	log.WithFields(log.Fields{
@@ -89,31 +365,72 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 	}).Info("Executing hook scripts.")
 
 	if rb.Async {
-		go rb.execute(in)
+		j, err := queue.submit(rb, in)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"hook":  id,
+				"error": err,
+			}).Error("Could not queue job!")
+			rec.fail(err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		rec.Job, rec.Outcome = j.ID, string(jobQueued)
 		log.WithFields(log.Fields{
 			"hook":        id,
 			"address":     r.RemoteAddr,
+			"job":         j.ID,
 			"num_scripts": len(rb.Scripts),
-		}).Info("Script execution started, returning 200.")
-		w.WriteHeader(200)
+		}).Info("Job queued, returning 202.")
+		w.Header().Set("Location", "/jobs/"+j.ID)
+		if rb.Response != nil {
+			data := newTemplateData(id, in)
+			data.Job = j.ID
+			writeHookResponse(w, rb, data, http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		data, _ := json.Marshal(map[string]string{"id": j.ID})
+		w.Write(data)
 		return
 	}
 
-	response, err := rb.execute(in)
+	j, err := queue.create(rb, in, "", false)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"hook":  id,
 			"error": err,
-		}).Error("Execute Error!")
+		}).Error("Could not record job!")
+		rec.fail(err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	queue.run(j)
+	rec.Job, rec.Outcome = j.ID, string(j.State)
+	if j.Error != "" {
+		log.WithFields(log.Fields{
+			"hook":  id,
+			"job":   j.ID,
+			"error": j.Error,
+		}).Error("Execute Error!")
+		http.Error(w, j.Error, 500)
+		return
+	}
+	response := j.Response
 	log.WithFields(log.Fields{
 		"hook":    id,
 		"address": r.RemoteAddr,
+		"job":     j.ID,
 		"time":    rb.ExecTime,
 	}).Info("Script execution complete.")
 
+	if rb.Response != nil {
+		data := newTemplateData(id, in)
+		data.Results = response.Results
+		writeHookResponse(w, rb, data, http.StatusOK)
+		return
+	}
 	if echo {
 		log.WithFields(log.Fields{
 			"hook":    id,
@@ -129,3 +446,133 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(data)
 	}
 }
+
+// writeHookResponse writes the response the runbook asks for, or a 500 if
+// it cannot be rendered.
+func writeHookResponse(w http.ResponseWriter, rb *runBook, data templateData, status int) {
+	if err := rb.Response.write(w, data, status, rb.redact); err != nil {
+		log.WithFields(log.Fields{
+			"hook":  rb.ID,
+			"error": err,
+		}).Error("Could not render response!")
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// callerAllowed reports whether r passes the access checks of rb. It guards
+// requests that act on a hook's jobs rather than calling the hook.
+func callerAllowed(rb *runBook, r *http.Request) bool {
+	// A signature or nonce is only good for the request it came with, so
+	// nothing else a caller sends shows it may read or repeat that request.
+	if rb.Signature != nil || rb.Nonce != nil {
+		return adminAuthorized(r)
+	}
+	if !rb.AddrIsAllowed(clientIP(r)) || !rb.ClientCertIsAllowed(r.TLS) || !rb.Authorized(r) {
+		return false
+	}
+	_, _, err := rb.verifyJWT(r)
+	return err == nil
+}
+
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	j, err := queue.get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if j.RunBook == nil || !callerAllowed(j.RunBook, r) {
+		log.WithFields(log.Fields{
+			"hook":    j.Hook,
+			"job":     id,
+			"address": r.RemoteAddr,
+		}).Warn("Not Authorized!")
+		http.Error(w, "Not authorized.", http.StatusUnauthorized)
+		return
+	}
+
+	data, err := json.MarshalIndent(j.status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	orig, err := queue.get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	rec := &auditRecord{
+		Event:         auditRequest,
+		Hook:          orig.Hook,
+		Client:        clientIP(r).String(),
+		Address:       r.RemoteAddr,
+		CertCN:        clientCertCN(r.TLS),
+		PayloadSHA256: payloadHash(orig.Input.Body),
+		ReplayOf:      orig.ID,
+	}
+	defer audit.write(rec)
+	if disabled.has(orig.Hook) {
+		rec.deny("hook disabled")
+		http.Error(w, "Hook is disabled.", http.StatusServiceUnavailable)
+		return
+	}
+	current := r.URL.Query().Get("current") != ""
+	rb, err := orig.replayRunBook(current)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":  orig.Hook,
+			"job":   id,
+			"error": err,
+		}).Error("RunBook Error!")
+		rec.fail(err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// Replaying requires access to the runbook that will be run.
+	if !callerAllowed(rb, r) {
+		log.WithFields(log.Fields{
+			"hook":    orig.Hook,
+			"job":     id,
+			"address": r.RemoteAddr,
+		}).Warn("Not Authorized!")
+		rec.deny("not authorized")
+		http.Error(w, "Not authorized.", http.StatusUnauthorized)
+		return
+	}
+
+	j, err := queue.create(rb, orig.replayInput(rb), orig.ID, true)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":  orig.Hook,
+			"job":   id,
+			"error": err,
+		}).Error("Could not queue job!")
+		rec.fail(err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	queue.enqueue(j)
+	rec.Decision, rec.Job, rec.Outcome = auditAllowed, j.ID, string(jobQueued)
+	log.WithFields(log.Fields{
+		"hook":     j.Hook,
+		"address":  r.RemoteAddr,
+		"job":      j.ID,
+		"replayOf": orig.ID,
+		"current":  current,
+	}).Info("Replay queued, returning 202.")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(map[string]string{"id": j.ID})
+	w.Write(data)
+}
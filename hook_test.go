@@ -2,6 +2,7 @@ package main
 
 import (
   "bytes"
+  "encoding/json"
   "fmt"
   log "github.com/Sirupsen/logrus"
   "io"
@@ -80,7 +81,7 @@ var exposePostHandlerScript = `
 var exposePostResponseBody = `{
   "results": [
     {
-      "stdout": "{\"Accept-Encoding\":\"gzip\",\"Authorization\":\"Basic Og==\",\"Content-Length\":\"16\",\"User-Agent\":\"Go 1.1 package http\"} {\"test\": \"test\"}",
+      "stdout": "{\"Accept-Encoding\":\"gzip\",\"Authorization\":\"[REDACTED]\",\"Content-Length\":\"16\",\"User-Agent\":\"Go 1.1 package http\"}\n{\"test\": \"test\"}",
       "stderr": "",
       "status_code": 0
     }
@@ -116,6 +117,7 @@ func TestHookHandler(t *testing.T) {
   // Set configdir option
   tempdir := os.TempDir()
   configdir = tempdir
+  queue, _ = newJobQueue("", 0)
 
   for _, tt := range hookHanderTests {
     // Set the echo config option.
@@ -123,24 +125,27 @@ func TestHookHandler(t *testing.T) {
 
     f, err := os.Create(path.Join(tempdir, "test.json"))
     if err != nil {
-      t.Errorf(err.Error())
+      t.Error(err)
     }
     defer os.Remove(f.Name())
     defer f.Close()
 
     _, err = f.WriteString(tt.script)
     if err != nil {
-      t.Errorf(err.Error())
+      t.Error(err)
     }
 
     req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", ts.URL, "test"), tt.postBody)
     req.SetBasicAuth(tt.token, "")
+    // Pin the User-Agent the expected output was recorded with; newer Go
+    // clients send their own.
+    req.Header.Set("User-Agent", "Go 1.1 package http")
     if err != nil {
-      t.Errorf(err.Error())
+      t.Error(err)
     }
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
-      t.Errorf(err.Error())
+      t.Error(err)
     }
     if resp.StatusCode != tt.statusCode {
       t.Errorf("wanted %d, got %d", tt.statusCode, resp.StatusCode)
@@ -148,10 +153,114 @@ func TestHookHandler(t *testing.T) {
 
     data, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-      t.Errorf(err.Error())
+      t.Error(err)
     }
     if string(data) != tt.body {
       t.Errorf("wanted %s, got %s", tt.body, string(data))
     }
   }
 }
+
+var dryRunScript = `
+{
+  "auth": "good_token",
+  "env": {
+    "STAGE": "prod"
+  },
+  "scripts": [
+    {
+      "command": "touch",
+      "args": [
+        "{{index .Headers \"X-Marker\"}}"
+      ],
+      "dir": "/tmp"
+    }
+  ]
+}`
+
+func TestDryRun(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  adminToken = "admin"
+  defer func() { adminToken = "" }()
+  if err := ioutil.WriteFile(path.Join(dir, "dry.json"), []byte(dryRunScript), 0644); err != nil {
+    t.Fatal(err)
+  }
+  marker := path.Join(dir, "marker")
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  tests := []struct {
+    token      string
+    admin      string
+    statusCode int
+  }{
+    {"good_token", "", 401},
+    {"bad_token", "admin", 401},
+    {"good_token", "admin", 200},
+  }
+  for _, tt := range tests {
+    req, err := http.NewRequest("POST", ts.URL+"/dry?dryRun=1", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    req.SetBasicAuth(tt.token, "")
+    req.Header.Set("X-Marker", marker)
+    if tt.admin != "" {
+      req.Header.Set(adminTokenHeader, tt.admin)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if resp.StatusCode != tt.statusCode {
+      t.Errorf("wanted %d, got %d", tt.statusCode, resp.StatusCode)
+    }
+    if resp.StatusCode != 200 {
+      resp.Body.Close()
+      continue
+    }
+    var plan dryRunResponse
+    if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+    s := plan.Scripts[0]
+    if len(s.Args) != 1 || s.Args[0] != marker || s.Dir != "/tmp" {
+      t.Errorf("unexpected plan: %+v", s)
+    }
+    if len(s.Env) != 2 || s.Env[1] != "STAGE=prod" {
+      t.Errorf("unexpected env: %v", s.Env)
+    }
+  }
+  if _, err := os.Stat(marker); err == nil {
+    t.Errorf("dry run executed the script")
+  }
+
+  queue, _ = newJobQueue("", 0)
+  for value, status := range map[string]int{"0": 200, "false": 200, "maybe": 400} {
+    req, _ := http.NewRequest("POST", ts.URL+"/dry?dryRun="+value, nil)
+    req.SetBasicAuth("good_token", "")
+    req.Header.Set("X-Marker", marker)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != status {
+      t.Errorf("dryRun=%s: wanted %d, got %d", value, status, resp.StatusCode)
+    }
+  }
+  if _, err := os.Stat(marker); err != nil {
+    t.Errorf("dryRun=false did not run the script")
+  }
+}
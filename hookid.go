@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// hookIDPattern matches hook ids: one or more path segments of letters,
+// digits, '_', '.' and '-' that do not start with '.', '_' or '-'. Segments
+// map to directories below the configdir.
+const hookIDPattern = `[A-Za-z0-9][A-Za-z0-9_.-]*(?:/[A-Za-z0-9][A-Za-z0-9_.-]*)*`
+
+const (
+	maxHookIDLength = 200
+
+	// defaultsName is the name, without extension, of the file holding the
+	// settings inherited by the runbooks in its directory and the
+	// directories below it.
+	defaultsName = "_defaults"
+)
+
+var hookIDRegexp = regexp.MustCompile("^" + hookIDPattern + "$")
+
+// reservedHookNamespaces are first path segments used by captainhook's own
+// endpoints.
+var reservedHookNamespaces = map[string]bool{
+	"jobs": true,
+}
+
+func validateHookID(id string) error {
+	if len(id) > maxHookIDLength || !hookIDRegexp.MatchString(id) {
+		return fmt.Errorf("invalid hook id '%s'", id)
+	}
+	if reservedHookNamespaces[strings.SplitN(id, "/", 2)[0]] {
+		return fmt.Errorf("hook id '%s' is reserved", id)
+	}
+	return nil
+}
+
+// within reports whether path is root or below it.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// settingsFile returns the file base is stored in, whichever format it is
+// written in, or "" if there is none. It is an error for more than one
+// format to exist.
+func settingsFile(base string) (string, error) {
+	var found []string
+	for _, ext := range runBookExtensions {
+		if _, err := os.Stat(base + ext); err == nil {
+			found = append(found, base+ext)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, len(found))
+	for i, f := range found {
+		names[i] = filepath.Base(f)
+	}
+	return "", fmt.Errorf("%s exists as %s, remove all but one", filepath.Base(base), strings.Join(names, " and "))
+}
+
+// findSettings returns the file name, a path below the configdir without
+// extension, is stored in, or "" if there is none. Symlinks are followed,
+// but must not lead out of the configdir.
+func findSettings(name string) (string, error) {
+	root, err := filepath.Abs(configdir)
+	if err != nil {
+		return "", err
+	}
+	path, err := settingsFile(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil || path == "" {
+		return path, err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if !within(realRoot, resolved) {
+		return "", fmt.Errorf("'%s' is outside the configdir", name)
+	}
+	return path, nil
+}
+
+// runBookPath returns the file the runbook id is read from. If there is no
+// such runbook the path of a JSON file is returned, which fails to be read.
+func runBookPath(id string) (string, error) {
+	if err := validateHookID(id); err != nil {
+		return "", err
+	}
+	path, err := findSettings(id)
+	if err != nil {
+		return "", fmt.Errorf("runbook %v", err)
+	}
+	if path == "" {
+		return filepath.Join(configdir, filepath.FromSlash(id)+".json"), nil
+	}
+	return path, nil
+}
+
+// mergeSettings returns base with over laid on top. Objects are merged key
+// by key, anything else in over replaces what is in base.
+func mergeSettings(base, over map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(base)+len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		b, bok := out[k].(map[string]interface{})
+		o, ook := v.(map[string]interface{})
+		if bok && ook {
+			out[k] = mergeSettings(b, o)
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// withDefaults lays the settings of runbook id over the defaults from the
+// config file and the defaults files found between the configdir and the
+// runbook's directory, outermost first.
+func withDefaults(id string, own map[string]interface{}) (map[string]interface{}, error) {
+	var layers []map[string]interface{}
+	if runBookDefaults != nil {
+		layers = append(layers, runBookDefaults)
+	}
+	dir := configdir
+	segments := strings.Split(id, "/")
+	for i := 0; i < len(segments); i++ {
+		if i > 0 {
+			dir = filepath.Join(dir, segments[i-1])
+		}
+		path, err := settingsFile(filepath.Join(dir, defaultsName))
+		if err != nil {
+			return nil, err
+		}
+		if path == "" {
+			continue
+		}
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		layer, err := expandSettings(path, d, nil)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	merged := make(map[string]interface{})
+	for _, layer := range append(layers, own) {
+		merged = mergeSettings(merged, layer)
+	}
+	return merged, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "reflect"
+  "sort"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+func TestValidateHookID(t *testing.T) {
+  tests := []struct {
+    id string
+    ok bool
+  }{
+    {"deploy", true},
+    {"teamA/deploy", true},
+    {"team-a/web_1/deploy.prod", true},
+    {"", false},
+    {"../etc/passwd", false},
+    {"teamA/../deploy", false},
+    {".hidden", false},
+    {"_defaults", false},
+    {"teamA//deploy", false},
+    {"teamA/deploy/", false},
+    {"/deploy", false},
+    {"dep loy", false},
+    {"jobs/deploy", false},
+  }
+  for _, tt := range tests {
+    if err := validateHookID(tt.id); (err == nil) != tt.ok {
+      t.Errorf("validateHookID(%q): wanted ok %v, got %v", tt.id, tt.ok, err)
+    }
+  }
+}
+
+func TestNestedRunBooks(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  outside, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(outside)
+  configdir = dir
+  queue, _ = newJobQueue("", 0)
+
+  os.MkdirAll(filepath.Join(dir, "teamA", "web"), 0755)
+  files := map[string]string{
+    "_defaults.json":           `{"env": {"TEAM": "none", "STAGE": "prod"}, "async": true}`,
+    "teamA/_defaults.json":     `{"env": {"TEAM": "a"}, "allowedNetworks": ["127.0.0.1/32"]}`,
+    "teamA/web/deploy.json":    `{"async": false, "scripts": [{"command": "echo", "args": ["{{.Hook}}"]}]}`,
+    "top.json":                 `{"scripts": []}`,
+    "teamA/web/_defaults.json": `{}`,
+  }
+  for name, data := range files {
+    if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  ioutil.WriteFile(filepath.Join(outside, "secret.json"), []byte(`{"scripts": []}`), 0644)
+  if err := os.Symlink(filepath.Join(outside, "secret.json"), filepath.Join(dir, "escape.json")); err != nil {
+    t.Fatal(err)
+  }
+
+  rb, err := getRunBookById("teamA/web/deploy")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if rb.Async {
+    t.Errorf("runbook setting did not override the defaults")
+  }
+  if want := map[string]string{"TEAM": "a", "STAGE": "prod"}; !reflect.DeepEqual(rb.Env, want) {
+    t.Errorf("wanted env %v, got %v", want, rb.Env)
+  }
+  if len(rb.AllowedNetworks.Networks) != 1 {
+    t.Errorf("allowedNetworks were not inherited: %+v", rb.AllowedNetworks)
+  }
+  if _, err := getRunBookById("escape"); err == nil {
+    t.Errorf("runbook outside the configdir was loaded")
+  }
+
+  ids, err := listRunBooks()
+  if err != nil {
+    t.Fatal(err)
+  }
+  sort.Strings(ids)
+  if want := []string{"escape", "teamA/web/deploy", "top"}; !reflect.DeepEqual(ids, want) {
+    t.Errorf("wanted runbooks %v, got %v", want, ids)
+  }
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id:"+hookIDPattern+"}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+  echo = true
+  defer func() { echo = false }()
+
+  resp, err := http.Post(ts.URL+"/teamA/web/deploy", "", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, _ := ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+  if resp.StatusCode != 200 || !strings.Contains(string(data), `teamA/web/deploy\n`) {
+    t.Errorf("unexpected response %d: %s", resp.StatusCode, data)
+  }
+  resp, err = http.Post(ts.URL+"/teamA/%2e%2e/top", "", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode == 200 {
+    t.Errorf("dot segments were accepted")
+  }
+}
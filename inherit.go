@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// settingsNamePattern matches the names extends and include refer to: paths
+// below the configdir without extension. Unlike hook ids, segments may start
+// with '_', so shared files can be kept where they cannot be called.
+var settingsNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(?:/[A-Za-z0-9_][A-Za-z0-9_.-]*)*$`)
+
+// readReference reads the file a runbook's extends or include refers to.
+func readReference(field, name string) (string, []byte, error) {
+	if !settingsNamePattern.MatchString(name) {
+		return "", nil, fmt.Errorf("%s: invalid name '%s'", field, name)
+	}
+	path, err := findSettings(name)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", field, err)
+	}
+	if path == "" {
+		return "", nil, fmt.Errorf("%s: '%s' does not exist", field, name)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", field, err)
+	}
+	return path, data, nil
+}
+
+// expandSettings decodes the runbook file at path and resolves its include
+// and extends. Included files lend their scripts, which run before the
+// runbook's own; the runbook's settings are laid over those of the one it
+// extends. seen holds the files being expanded, to catch cycles.
+func expandSettings(path string, data []byte, seen []string) (map[string]interface{}, error) {
+	for i, p := range seen {
+		if p == path {
+			chain := make([]string, 0, len(seen)-i+1)
+			for _, s := range append(seen[i:], path) {
+				chain = append(chain, filepath.Base(s))
+			}
+			return nil, fmt.Errorf("cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	seen = append(seen, path)
+
+	settings, err := decodeSettings(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+
+	if v, ok := settings["include"]; ok {
+		names, ok := stringList(v)
+		if !ok {
+			return nil, fmt.Errorf("%s: include must be a list of names", filepath.Base(path))
+		}
+		var scripts []interface{}
+		for _, name := range names {
+			p, d, err := readReference("include", name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+			}
+			included, err := expandSettings(p, d, seen)
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := included["scripts"].([]interface{}); ok {
+				scripts = append(scripts, s...)
+			}
+		}
+		if own, ok := settings["scripts"].([]interface{}); ok {
+			scripts = append(scripts, own...)
+		}
+		settings["scripts"] = scripts
+		delete(settings, "include")
+	}
+
+	if v, ok := settings["extends"]; ok {
+		name, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: extends must be a name", filepath.Base(path))
+		}
+		p, d, err := readReference("extends", name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		base, err := expandSettings(p, d, seen)
+		if err != nil {
+			return nil, err
+		}
+		delete(settings, "extends")
+		settings = mergeSettings(base, settings)
+	}
+	return settings, nil
+}
+
+func stringList(v interface{}) ([]string, bool) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	s := make([]string, len(list))
+	for i, x := range list {
+		if s[i], ok = x.(string); !ok {
+			return nil, false
+		}
+	}
+	return s, true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestRunBookInheritance(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  os.MkdirAll(filepath.Join(dir, "_templates"), 0755)
+
+  files := map[string]string{
+    "_templates/notify.json": `{"scripts": [{"command": "notify.sh", "args": ["${vars.repo}"]}]}`,
+    "_templates/deploy.yaml": `
+include: [_templates/notify]
+env:
+  REPO: git@example.com:${vars.repo}.git
+  STAGE: prod
+vars:
+  branch: main
+scripts:
+  - command: deploy.sh
+    args: [--branch, "${vars.branch}"]
+`,
+    "web.json":      `{"extends": "_templates/deploy", "vars": {"repo": "web"}, "env": {"STAGE": "staging"}}`,
+    "api.json":      `{"extends": "_templates/deploy", "vars": {"repo": "api", "branch": "release"}}`,
+    "loop-a.json":   `{"extends": "loop-b"}`,
+    "loop-b.json":   `{"extends": "loop-a"}`,
+    "orphan.json":   `{"extends": "_templates/missing"}`,
+    "unset.json":    `{"extends": "_templates/deploy"}`,
+    "escape.json":   `{"extends": "../etc/passwd"}`,
+    "self-inc.json": `{"include": ["self-inc"]}`,
+  }
+  for name, data := range files {
+    if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  tests := []struct {
+    id   string
+    env  map[string]string
+    args [][]string
+  }{
+    {
+      "web",
+      map[string]string{"REPO": "git@example.com:web.git", "STAGE": "staging"},
+      [][]string{{"web"}, {"--branch", "main"}},
+    },
+    {
+      "api",
+      map[string]string{"REPO": "git@example.com:api.git", "STAGE": "prod"},
+      [][]string{{"api"}, {"--branch", "release"}},
+    },
+  }
+  for _, tt := range tests {
+    rb, err := getRunBookById(tt.id)
+    if err != nil {
+      t.Errorf("%s: %v", tt.id, err)
+      continue
+    }
+    if !reflect.DeepEqual(rb.Env, tt.env) {
+      t.Errorf("%s: wanted env %v, got %v", tt.id, tt.env, rb.Env)
+    }
+    var args [][]string
+    for _, s := range rb.Scripts {
+      args = append(args, s.Args)
+    }
+    if !reflect.DeepEqual(args, tt.args) {
+      t.Errorf("%s: wanted script args %v, got %v", tt.id, tt.args, args)
+    }
+    if rb.Extends != "" || len(rb.Include) != 0 {
+      t.Errorf("%s: extends and include were not resolved", tt.id)
+    }
+  }
+
+  failures := []struct {
+    id  string
+    err string
+  }{
+    {"loop-a", "cycle: loop-a.json -> loop-b.json -> loop-a.json"},
+    {"orphan", "'_templates/missing' does not exist"},
+    {"unset", "'repo' is not set"},
+    {"escape", "invalid name"},
+    {"self-inc", "cycle"},
+  }
+  for _, tt := range failures {
+    if _, err := getRunBookById(tt.id); err == nil || !strings.Contains(err.Error(), tt.err) {
+      t.Errorf("%s: wanted an error about %q, got %v", tt.id, tt.err, err)
+    }
+  }
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// refPattern matches ${...} references in runbook values. $${...} stands for
+// a literal ${...}.
+var refPattern = regexp.MustCompile(`\$(\$?)\{([^{}]*)\}`)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interpolator resolves the references in runbook values when a runbook is
+// loaded:
+//
+//	${vars.name}            name from the runbook's vars
+//	${NAME} ${NAME:-value}  environment variable NAME, or value if unset
+//	${secret:NAME}          environment variable NAME, which is a secret
+//	${file:/path}           contents of a file, relative to the configdir
+//
+// Values read from files and environment variables marked secret are
+// redacted from then on.
+type interpolator struct {
+	vars   map[string]string
+	strict bool
+}
+
+func (ip *interpolator) lookup(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "vars."):
+		name := strings.TrimPrefix(ref, "vars.")
+		v, ok := ip.vars[name]
+		if !ok {
+			return "", fmt.Errorf("vars: '%s' is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(configdir, path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		v := strings.TrimRight(string(data), "\r\n")
+		redactions.addSecret(v)
+		return v, nil
+	}
+	secret := strings.HasPrefix(ref, "secret:")
+	ref = strings.TrimPrefix(ref, "secret:")
+	name, fallback := ref, ""
+	hasFallback := false
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		name, fallback, hasFallback = ref[:i], ref[i+2:], true
+	}
+	if !envNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid reference '${%s}'", ref)
+	}
+	v, ok := os.LookupEnv(name)
+	switch {
+	case ok:
+		if secret {
+			redactions.addSecret(v)
+		}
+		return v, nil
+	case hasFallback:
+		return fallback, nil
+	case ip.strict:
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	log.WithField("variable", name).Warn("Environment variable is not set, using nothing.")
+	return "", nil
+}
+
+func (ip *interpolator) expand(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	out := refPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := refPattern.FindStringSubmatch(ref)
+		if m[1] != "" {
+			return ref[1:]
+		}
+		v, e := ip.lookup(m[2])
+		if e != nil && err == nil {
+			err = e
+		}
+		return v
+	})
+	return out, err
+}
+
+// value returns v with every string in it expanded. Nested values are
+// copied, as they may be shared with the defaults.
+func (ip *interpolator) value(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return ip.expand(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			var err error
+			if out[k], err = ip.value(x); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, x := range v {
+			var err error
+			if out[i], err = ip.value(x); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// interpolate resolves the references in runbook settings. Vars may
+// themselves refer to the environment and files, but not to other vars.
+// With strictEnv set an unset environment variable without a default fails
+// the load; otherwise it is replaced by nothing.
+func interpolate(settings map[string]interface{}) error {
+	ip := &interpolator{vars: make(map[string]string)}
+	ip.strict, _ = settings["strictEnv"].(bool)
+	if v, ok := settings["vars"].(map[string]interface{}); ok {
+		for name, value := range v {
+			s, err := configValue(value)
+			if err != nil {
+				return fmt.Errorf("vars: %s: %v", name, err)
+			}
+			if strings.Contains(s, "${vars.") {
+				return fmt.Errorf("vars: %s: vars cannot refer to other vars", name)
+			}
+			if ip.vars[name], err = ip.expand(s); err != nil {
+				return fmt.Errorf("vars: %s: %v", name, err)
+			}
+		}
+	}
+	for k, v := range settings {
+		if k == "vars" {
+			continue
+		}
+		var err error
+		if settings[k], err = ip.value(v); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestInterpolate(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  ioutil.WriteFile(filepath.Join(dir, "deploy-key"), []byte("file-secret-value\n"), 0600)
+  os.Setenv("CAPTAINHOOK_TEST_TOKEN", "env-secret-value")
+  defer os.Unsetenv("CAPTAINHOOK_TEST_TOKEN")
+  os.Setenv("CAPTAINHOOK_TEST_PLAIN", "env-plain-value")
+  defer os.Unsetenv("CAPTAINHOOK_TEST_PLAIN")
+  os.Unsetenv("CAPTAINHOOK_TEST_MISSING")
+
+  tests := []struct {
+    in     string
+    strict bool
+    want   string
+    err    bool
+  }{
+    {"${secret:CAPTAINHOOK_TEST_TOKEN}", false, "env-secret-value", false},
+    {"Bearer ${secret:CAPTAINHOOK_TEST_TOKEN}!", false, "Bearer env-secret-value!", false},
+    {"${CAPTAINHOOK_TEST_PLAIN}", false, "env-plain-value", false},
+    {"${secret:CAPTAINHOOK_TEST_MISSING:-fallback}", true, "fallback", false},
+    {"${CAPTAINHOOK_TEST_MISSING:-fallback}", true, "fallback", false},
+    {"${CAPTAINHOOK_TEST_MISSING:-}", true, "", false},
+    {"[${CAPTAINHOOK_TEST_MISSING}]", false, "[]", false},
+    {"${CAPTAINHOOK_TEST_MISSING}", true, "", true},
+    {"${file:deploy-key}", false, "file-secret-value", false},
+    {"${file:" + filepath.Join(dir, "deploy-key") + "}", false, "file-secret-value", false},
+    {"${file:nope}", false, "", true},
+    {"${vars.repo}-${vars.env}", false, "web-env-secret-value", false},
+    {"$${HOME} and $${vars.repo}", true, "${HOME} and ${vars.repo}", false},
+    {"${not a name}", false, "", true},
+  }
+  for _, tt := range tests {
+    settings := map[string]interface{}{
+      "strictEnv": tt.strict,
+      "vars":      map[string]interface{}{"repo": "web", "env": "${secret:CAPTAINHOOK_TEST_TOKEN}"},
+      "args":      []interface{}{tt.in},
+    }
+    err := interpolate(settings)
+    if tt.err {
+      if err == nil {
+        t.Errorf("%q: unexpectedly interpolated to %v", tt.in, settings["args"])
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%q: %v", tt.in, err)
+      continue
+    }
+    if got := settings["args"].([]interface{})[0]; got != tt.want {
+      t.Errorf("%q: wanted %q, got %q", tt.in, tt.want, got)
+    }
+  }
+
+  for _, secret := range []string{"env-secret-value", "file-secret-value"} {
+    if got := redactions.redact("value is " + secret); strings.Contains(got, secret) {
+      t.Errorf("interpolated secret was not redacted: %s", got)
+    }
+  }
+  if got := redactions.redact("value is env-plain-value"); got != "value is env-plain-value" {
+    t.Errorf("plain environment variable was redacted: %s", got)
+  }
+
+  // An unset variable is named in a warning.
+  var buf bytes.Buffer
+  log.SetOutput(&buf)
+  log.SetLevel(log.WarnLevel)
+  interpolate(map[string]interface{}{"args": []interface{}{"${CAPTAINHOOK_TEST_MISSING}"}})
+  log.SetOutput(os.Stderr)
+  log.SetLevel(log.ErrorLevel)
+  if !strings.Contains(buf.String(), "CAPTAINHOOK_TEST_MISSING") {
+    t.Errorf("unset variable was not logged: %q", buf.String())
+  }
+
+  script := `{"auth": {"token": "${CAPTAINHOOK_TEST_TOKEN}"}, "scripts": [{"command": "true", "args": ["${CAPTAINHOOK_TEST_MISSING}"]}]}`
+  ioutil.WriteFile(filepath.Join(dir, "interpolated.json"), []byte(script), 0644)
+  rb, err := getRunBookById("interpolated")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if rb.Auth[0].Token != "env-secret-value" || rb.Scripts[0].Args[0] != "" {
+    t.Errorf("unexpected runbook: %+v", rb)
+  }
+  ioutil.WriteFile(filepath.Join(dir, "_defaults.json"), []byte(`{"strictEnv": true}`), 0644)
+  if _, err := getRunBookById("interpolated"); err == nil || !strings.Contains(err.Error(), "CAPTAINHOOK_TEST_MISSING is not set") {
+    t.Errorf("wanted an error about the unset variable, got %v", err)
+  }
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// jwtConfig turns on JWT bearer token authentication for a runbook. Tokens
+// are verified against the keys in a local JWKS file and/or PEM public key
+// files.
+type jwtConfig struct {
+	JWKS           string                 `json:"jwks,omitempty"`
+	Keys           []string               `json:"keys,omitempty"`
+	Issuer         string                 `json:"issuer,omitempty"`
+	Audience       string                 `json:"audience,omitempty"`
+	RequiredClaims map[string]interface{} `json:"requiredClaims,omitempty"`
+	ExposeClaims   []string               `json:"exposeClaims,omitempty"`
+	Leeway         duration               `json:"leeway,omitempty"`
+}
+
+type jwtKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+func (c *jwtConfig) validate() error {
+	if c.JWKS == "" && len(c.Keys) == 0 {
+		return fmt.Errorf("jwt needs jwks or keys")
+	}
+	return nil
+}
+
+// keys loads the verification keys. They are read on every request so that
+// key rotation does not need a restart.
+func (c *jwtConfig) keys() ([]jwtKey, error) {
+	var keys []jwtKey
+	if c.JWKS != "" {
+		data, err := ioutil.ReadFile(c.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		if keys, err = parseJWKS(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.JWKS, err)
+		}
+	}
+	for _, f := range c.Keys {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePEMPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		keys = append(keys, jwtKey{key: key})
+	}
+	return keys, nil
+}
+
+func parsePEMPublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := b64Int(k.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := b64Int(k.E)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jwtKey{k.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}})
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+			}
+			x, err := b64Int(k.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := b64Int(k.Y)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jwtKey{k.Kid, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}})
+		case "OKP":
+			if k.Crv != "Ed25519" {
+				return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, err
+			}
+			// ed25519.Verify panics on keys of any other size.
+			if len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("Ed25519 key '%s' is %d bytes, not %d", k.Kid, len(x), ed25519.PublicKeySize)
+			}
+			keys = append(keys, jwtKey{k.Kid, ed25519.PublicKey(x)})
+		}
+	}
+	return keys, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// verifyJWTSignature checks sig over signed with key according to alg.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, signed, sig) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg '%s'", alg)
+	}
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported alg '%s'", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "RS", "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg '%s'", alg)
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match alg '%s'", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("bad signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}
+	// HMAC and "none" are refused, only public keys are configured.
+	return fmt.Errorf("unsupported alg '%s'", alg)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// claimMatches reports whether claim equals want, or contains it if the
+// claim is a list.
+func claimMatches(claim, want interface{}) bool {
+	if list, ok := claim.([]interface{}); ok {
+		for _, v := range list {
+			if claimMatches(v, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(claim) == fmt.Sprint(want)
+}
+
+// verify checks the bearer token of req and returns its claims.
+func (c *jwtConfig) verify(req *http.Request, now time.Time) (map[string]interface{}, error) {
+	h := req.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	parts := strings.Split(strings.TrimSpace(h[7:]), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	keys, err := c.keys()
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, k.key, signed, sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("token signature could not be verified")
+	}
+
+	claims := make(map[string]interface{})
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	leeway := time.Duration(c.Leeway)
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.After(exp.Add(leeway)) {
+		return nil, fmt.Errorf("token expired at %v", exp)
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(leeway).Before(nbf) {
+		return nil, fmt.Errorf("token not valid before %v", nbf)
+	}
+	if c.Issuer != "" && claims["iss"] != c.Issuer {
+		return nil, fmt.Errorf("token issuer '%v' is not '%s'", claims["iss"], c.Issuer)
+	}
+	if c.Audience != "" && !claimMatches(claims["aud"], c.Audience) {
+		return nil, fmt.Errorf("token audience '%v' does not include '%s'", claims["aud"], c.Audience)
+	}
+	for name, want := range c.RequiredClaims {
+		if v, ok := claims[name]; !ok || !claimMatches(v, want) {
+			return nil, fmt.Errorf("token claim '%s' is not '%v'", name, want)
+		}
+	}
+	return claims, nil
+}
+
+// exposed returns the claims that are handed to scripts, as strings. Lists
+// are joined with commas.
+func (c *jwtConfig) exposed(claims map[string]interface{}) map[string]string {
+	if len(c.ExposeClaims) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(c.ExposeClaims))
+	for _, name := range c.ExposeClaims {
+		v, ok := claims[name]
+		if !ok {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			out[name] = v
+		case []interface{}:
+			s := make([]string, len(v))
+			for i, x := range v {
+				s[i] = fmt.Sprint(x)
+			}
+			out[name] = strings.Join(s, ",")
+		case float64, bool:
+			out[name] = fmt.Sprint(v)
+		default:
+			data, _ := json.Marshal(v)
+			out[name] = string(data)
+		}
+	}
+	return out
+}
+
+var envNameInvalid = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// envName turns a name into something usable as an environment variable.
+func envName(prefix, name string) string {
+	return prefix + envNameInvalid.ReplaceAllString(strings.ToUpper(name), "_")
+}
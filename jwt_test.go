@@ -0,0 +1,199 @@
+package main
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/json"
+  "encoding/pem"
+  "io/ioutil"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+func b64(data []byte) string {
+  return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+  header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+  payload, _ := json.Marshal(claims)
+  signed := b64(header) + "." + b64(payload)
+  digest := sha256.Sum256([]byte(signed))
+  var sig []byte
+  switch k := key.(type) {
+  case *rsa.PrivateKey:
+    var err error
+    if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+      t.Fatal(err)
+    }
+  case *ecdsa.PrivateKey:
+    r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+    if err != nil {
+      t.Fatal(err)
+    }
+    sig = make([]byte, 64)
+    r.FillBytes(sig[:32])
+    s.FillBytes(sig[32:])
+  }
+  return signed + "." + b64(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+  ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+  jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+    "kty": "RSA", "kid": "rsa1", "use": "sig",
+    "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+  }}})
+  ioutil.WriteFile(filepath.Join(dir, "jwks.json"), jwks, 0644)
+  der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+  ioutil.WriteFile(filepath.Join(dir, "ec.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+  c := jwtConfig{
+    JWKS:           filepath.Join(dir, "jwks.json"),
+    Keys:           []string{filepath.Join(dir, "ec.pem")},
+    Issuer:         "https://id.example.com",
+    Audience:       "captainhook",
+    RequiredClaims: map[string]interface{}{"groups": "deployers"},
+    ExposeClaims:   []string{"sub", "groups", "missing"},
+  }
+  now := time.Now()
+  claims := func(over map[string]interface{}) map[string]interface{} {
+    cl := map[string]interface{}{
+      "iss":    "https://id.example.com",
+      "aud":    []string{"other", "captainhook"},
+      "sub":    "ci-bot",
+      "groups": []string{"deployers", "ops"},
+      "exp":    now.Add(time.Minute).Unix(),
+    }
+    for k, v := range over {
+      if v == nil {
+        delete(cl, k)
+      } else {
+        cl[k] = v
+      }
+    }
+    return cl
+  }
+
+  tests := []struct {
+    token string
+    ok    bool
+  }{
+    {signJWT(t, "RS256", "rsa1", rsaKey, claims(nil)), true},
+    {signJWT(t, "ES256", "", ecKey, claims(nil)), true},
+    {signJWT(t, "RS256", "rsa1", otherKey, claims(nil)), false},
+    {signJWT(t, "RS256", "rsa2", rsaKey, claims(nil)), false},
+    {signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), false},
+    {signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"exp": nil})), false},
+    {signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), false},
+    {signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+    {signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"aud": "other"})), false},
+    {signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"groups": "ops"})), false},
+    {b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"x"}`)) + ".", false},
+    {"garbage", false},
+  }
+  for i, tt := range tests {
+    req, _ := http.NewRequest("POST", "/test", nil)
+    req.Header.Set("Authorization", "Bearer "+tt.token)
+    got, err := c.verify(req, now)
+    if (err == nil) != tt.ok {
+      t.Errorf("test %d: unexpected result %v", i, err)
+      continue
+    }
+    if err != nil {
+      continue
+    }
+    exposed := c.exposed(got)
+    if exposed["sub"] != "ci-bot" || exposed["groups"] != "deployers,ops" || len(exposed) != 2 {
+      t.Errorf("test %d: unexpected exposed claims %v", i, exposed)
+    }
+  }
+}
+
+func TestJWTClaimsReachScripts(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  echo = true
+  defer func() { echo = false }()
+  queue, _ = newJobQueue("", 0)
+
+  key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+  ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+  script := `{
+    "jwt": {"keys": ["` + filepath.Join(dir, "key.pem") + `"], "exposeClaims": ["sub"]},
+    "scripts": [{"command": "sh", "args": ["-c", "echo {{.Claims.sub}} $CAPTAINHOOK_CLAIM_SUB"]}]
+  }`
+  ioutil.WriteFile(filepath.Join(dir, "jwt.json"), []byte(script), 0644)
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  token := signJWT(t, "ES256", "", key, map[string]interface{}{"sub": "ci-bot", "exp": time.Now().Add(time.Minute).Unix()})
+  for _, auth := range []string{"", "Bearer " + token} {
+    req, _ := http.NewRequest("POST", ts.URL+"/jwt", nil)
+    if auth != "" {
+      req.Header.Set("Authorization", auth)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    data, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if auth == "" {
+      if resp.StatusCode != 401 {
+        t.Errorf("without token: wanted 401, got %d", resp.StatusCode)
+      }
+      continue
+    }
+    if !strings.Contains(string(data), `"stdout": "ci-bot ci-bot\n"`) {
+      t.Errorf("claims did not reach the script: %s", data)
+    }
+  }
+}
+
+func TestParseJWKSEd25519(t *testing.T) {
+  for size, ok := range map[int]bool{32: true, 31: false, 0: false, 64: false} {
+    jwks := `{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "k", "x": "` + b64(make([]byte, size)) + `"}]}`
+    keys, err := parseJWKS([]byte(jwks))
+    if (err == nil) != ok {
+      t.Errorf("%d byte key: unexpected error %v", size, err)
+    }
+    if ok && len(keys) != 1 {
+      t.Errorf("%d byte key: wanted 1 key, got %d", size, len(keys))
+    }
+  }
+}
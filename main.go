@@ -1,14 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-
-	"github.com/gorilla/mux"
 )
 
 const (
@@ -16,21 +18,62 @@ const (
 )
 
 var (
-	configdir   string
-	echo        bool
-	listenAddr  string
-	logLevel    int
-	logFile     string
-	showVersion bool
+	adminAddr     string
+	adminToken    string
+	auditChain    bool
+	auditDest     string
+	configFile    string
+	configdir     string
+	dataDir       string
+	drainDelay    time.Duration
+	echo          bool
+	healthPath    string
+	listenAddr    string
+	logLevel      int
+	logFile       string
+	maxBodyBytes  int64
+	rateBurst     int
+	rateLimitBy   string
+	rateLimitSpec string
+	readyPath     string
+	showVersion   bool
+	tlsCert       string
+	tlsClientCA   string
+	tlsKey        string
+	versionPath   string
+	workers       int
+
+	queue *jobQueue
+	sched *scheduler
 )
 
 func init() {
+	flag.StringVar(&adminAddr, "admin-addr", "", "admin api listen address (default: disabled)")
+	flag.StringVar(&adminToken, "admin-token", "", "token required by the admin api")
+	flag.StringVar(&auditDest, "audit-log", "", "audit log file, or syslog or syslog://host:port (default: none)")
+	flag.BoolVar(&auditChain, "audit-chain", false, "chain audit records by hash so tampering can be detected")
+	flag.StringVar(&configFile, "config", "", "server config file (YAML, JSON or TOML); flags override it")
 	flag.StringVar(&configdir, "configdir", "", "config dir to use")
+	flag.StringVar(&dataDir, "datadir", "", "dir to persist jobs in (default: jobs are kept in memory)")
+	flag.DurationVar(&drainDelay, "drain-delay", 5*time.Second, "how long to keep serving after SIGTERM while readiness fails")
 	flag.BoolVar(&echo, "echo", false, "send output from script")
+	flag.StringVar(&healthPath, "health-path", "/healthz", "path of the liveness probe (empty: disabled)")
 	flag.StringVar(&listenAddr, "listen-addr", "127.0.0.1:8080", "http listen address")
 	flag.IntVar(&logLevel, "v", 1, "log level (0:quiet 1:info/default 2:debug)")
 	flag.StringVar(&logFile, "log", "", "log file (default: STDOUT)")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", defaultMaxBodyBytes, "largest request body accepted, after decoding (0: no limit)")
+	flag.StringVar(&readyPath, "ready-path", "/readyz", "path of the readiness probe (empty: disabled)")
 	flag.BoolVar(&showVersion, "version", false, "Show version and exit")
+	flag.StringVar(&versionPath, "version-path", "/version", "path of the version endpoint (empty: disabled)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file (default: serve plain http)")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file to verify client certificates against")
+	flag.StringVar(&rateLimitSpec, "rate-limit", "", "default rate limit for hooks, as requests/interval, e.g. 10/1m (default: none)")
+	flag.IntVar(&rateBurst, "rate-burst", 0, "burst allowed by the default rate limit (default: the number of requests)")
+	flag.StringVar(&rateLimitBy, "rate-limit-by", limitByHookClient, "what the default rate limit is kept per: hook, client or hook+client")
+	flag.Var(&trustedProxies, "trusted-proxies", "comma separated CIDRs of proxies whose forwarding header is honored")
+	flag.StringVar(&forwardedHeader, "forwarded-header", headerXFF, "forwarding header the trusted proxies set: xff, forwarded or x-real-ip")
+	flag.IntVar(&workers, "workers", 4, "number of async jobs to run at once")
 }
 
 func main() {
@@ -39,6 +82,16 @@ func main() {
 		fmt.Printf("%s\n", Version)
 		os.Exit(0)
 	}
+	if configFile != "" {
+		if err := loadConfig(configFile); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+	}
+	// Some commands need no configdir.
+	if flag.NArg() > 0 && configFree(flag.Arg(0)) {
+		os.Exit(runCommand(flag.Args()))
+	}
 	if configdir == "" {
 		os.Stderr.WriteString("configdir is required\n")
 		os.Exit(1)
@@ -53,6 +106,8 @@ func main() {
 			log.SetOutput(out)
 		}
 	}
+	log.SetFormatter(redactingFormatter{log.StandardLogger().Formatter})
+	redactions.addSecret(adminToken)
 	switch {
 	case logLevel < 1:
 		log.SetLevel(log.ErrorLevel)
@@ -62,15 +117,126 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/{id}", hookHandler).Methods("POST")
-	http.Handle("/", r)
+	if auditDest != "" {
+		var err error
+		if audit, err = newAuditLog(auditDest, auditChain); err != nil {
+			log.WithField("error", err).Fatal("Audit Log Error!")
+		}
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+	if workers < 1 {
+		os.Stderr.WriteString("workers must be at least 1\n")
+		os.Exit(1)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		os.Stderr.WriteString("tls-cert and tls-key must be given together\n")
+		os.Exit(1)
+	}
+	if tlsClientCA != "" && tlsCert == "" {
+		os.Stderr.WriteString("tls-client-ca requires tls-cert and tls-key\n")
+		os.Exit(1)
+	}
+	if rateLimitSpec != "" {
+		globalRateLimit = &rateLimit{Rate: rateLimitSpec, Burst: rateBurst, By: rateLimitBy}
+		if err := globalRateLimit.parse(); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+	}
+	if err := validateForwardedHeader(forwardedHeader); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	if err := checkProbeCollisions(); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	if err := reserveProbePaths(); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	if adminAddr != "" && adminToken == "" {
+		os.Stderr.WriteString("admin-token is required with admin-addr\n")
+		os.Exit(1)
+	}
+
+	jobDir := ""
+	if dataDir != "" {
+		jobDir = filepath.Join(dataDir, "jobs")
+	} else {
+		log.Warn("No datadir given, async jobs will not survive a restart.")
+	}
+	var err error
+	if queue, err = newJobQueue(jobDir, workers); err != nil {
+		log.WithField("error", err).Fatal("Job Queue Error!")
+	}
+	if err = queue.recover(); err != nil {
+		log.WithField("error", err).Fatal("Job Queue Error!")
+	}
+
+	if dataDir != "" {
+		if nonces, err = newNonceCache(filepath.Join(dataDir, "nonces.log")); err != nil {
+			log.WithField("error", err).Fatal("Nonce Cache Error!")
+		}
+		if disabled, err = newDisabledHooks(filepath.Join(dataDir, "disabled.json")); err != nil {
+			log.WithField("error", err).Fatal("Disabled Hooks Error!")
+		}
+	}
+
+	sched = newScheduler(queue)
+	go sched.run()
+
+	var tlsConfig *tls.Config
+	if tlsCert != "" {
+		certs, err := newCertReloader(tlsCert, tlsKey, tlsClientCA)
+		if err != nil {
+			log.WithField("error", err).Fatal("TLS Error!")
+		}
+		go certs.watch()
+		tlsConfig = certs.config()
+	}
+
+	servers := []*http.Server{}
+	if adminAddr != "" {
+		admin := &http.Server{Addr: adminAddr, Handler: adminRouter(), TLSConfig: tlsConfig}
+		servers = append(servers, admin)
+		log.WithFields(log.Fields{
+			"listen": adminAddr,
+			"tls":    tlsConfig != nil,
+		}).Info("Starting admin api.")
+		go func() {
+			if err := serve(admin); err != nil && err != http.ErrServerClosed {
+				log.WithField("error", err).Fatal("Admin Server Error!")
+			}
+		}()
+	}
+
+	routes.reload()
+	go routes.watch()
+	server := &http.Server{Addr: listenAddr, Handler: routes, TLSConfig: tlsConfig}
+	drained := drainOnSignal(append(servers, server)...)
+	atomic.StoreInt32(&ready, 1)
 
 	log.WithFields(log.Fields{
 		"listen":     listenAddr,
 		"config-dir": configdir,
+		"data-dir":   dataDir,
+		"tls":        tlsCert != "",
 	}).Infof("=== Booting CaptainHook %s, matey! Arr!", Version)
-	if err := http.ListenAndServe(listenAddr, nil); err != nil {
+	if err = serve(server); err != nil && err != http.ErrServerClosed {
 		log.WithField("error", err).Fatal("Server Error!")
 	}
+	<-drained
+	log.Info("Stopped.")
+}
+
+// serve runs s, over TLS if it has a TLS config.
+func serve(s *http.Server) error {
+	if s.TLSConfig != nil {
+		return s.ListenAndServeTLS("", "")
+	}
+	return s.ListenAndServe()
 }
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"expvar"
+)
+
+// metrics are published with expvar and served by the admin api.
+var (
+	metrics         = expvar.NewMap("captainhook")
+	throttledByHook = new(expvar.Map).Init()
+	requestsByHook  = new(expvar.Map).Init()
+)
+
+func init() {
+	metrics.Set("requests", requestsByHook)
+	metrics.Set("throttled", throttledByHook)
+}
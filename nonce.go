@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultNonceRetention = 24 * time.Hour
+
+// nonceConfig turns on duplicate detection for a runbook, keyed by a
+// delivery id header.
+type nonceConfig struct {
+	Header    string   `json:"header"`
+	Retention duration `json:"retention,omitempty"`
+}
+
+func (n *nonceConfig) retention() time.Duration {
+	if n.Retention > 0 {
+		return time.Duration(n.Retention)
+	}
+	return defaultNonceRetention
+}
+
+type nonceEntry struct {
+	Hook    string    `json:"hook"`
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// nonceCache remembers delivery ids until they expire. When it has a file,
+// every id is appended and flushed before it is accepted, so a restart does
+// not reopen the window.
+type nonceCache struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]time.Time
+}
+
+// nonces is the delivery id cache. It is kept in memory until main opens
+// one in the datadir.
+var nonces = &nonceCache{entries: make(map[string]time.Time)}
+
+func nonceKey(hook, id string) string {
+	return hook + "\x00" + id
+}
+
+// newNonceCache loads the unexpired ids from path, if given, and compacts
+// the file.
+func newNonceCache(path string) (*nonceCache, error) {
+	c := &nonceCache{path: path, entries: make(map[string]time.Time)}
+	if path == "" {
+		return c, nil
+	}
+	now := time.Now()
+	var live []nonceEntry
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e nonceEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// A torn last line from a crash.
+				continue
+			}
+			if e.Expires.After(now) {
+				c.entries[nonceKey(e.Hook, e.ID)] = e.Expires
+				live = append(live, e)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range live {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if c.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// check records id for hook, failing if it has been seen within its
+// retention window.
+func (c *nonceCache) check(hook, id string, retention time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	key := nonceKey(hook, id)
+	if exp, ok := c.entries[key]; ok && exp.After(now) {
+		return fmt.Errorf("delivery '%s' was already received", id)
+	}
+	for k, exp := range c.entries {
+		if !exp.After(now) {
+			delete(c.entries, k)
+		}
+	}
+	e := nonceEntry{Hook: hook, ID: id, Expires: now.Add(retention)}
+	if c.file != nil {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := c.file.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		if err := c.file.Sync(); err != nil {
+			return err
+		}
+	}
+	c.entries[key] = e.Expires
+	return nil
+}
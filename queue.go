@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type jobState string
+
+const (
+	jobQueued      jobState = "queued"
+	jobRunning     jobState = "running"
+	jobSucceeded   jobState = "succeeded"
+	jobFailed      jobState = "failed"
+	jobInterrupted jobState = "interrupted"
+)
+
+const (
+	// onRestartResume re-runs a job that was interrupted by a restart.
+	onRestartResume = "resume"
+	// onRestartInterrupt marks a job that was interrupted by a restart as
+	// such and leaves it alone. This is the default.
+	onRestartInterrupt = "interrupt"
+
+	// maxMemoryJobs bounds the number of finished jobs kept around when
+	// there is no data dir to persist them to, and the number of finished
+	// jobs on disk recent knows about.
+	maxMemoryJobs = 1000
+)
+
+// job is a single invocation of a runBook. Jobs are persisted as JSON so
+// that async invocations survive a restart.
+type job struct {
+	ID       string `json:"id"`
+	Hook     string `json:"hook"`
+	ReplayOf string `json:"replayOf,omitempty"`
+	// Async is set for jobs nobody waits on: async calls, admin triggers
+	// and replays. Only those are picked up again after a restart.
+	Async    bool             `json:"async,omitempty"`
+	State    jobState         `json:"state"`
+	RunBook  *runBook         `json:"runbook"`
+	Input    input            `json:"input"`
+	Created  time.Time        `json:"created"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+	Response *runBookResponse `json:"response,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// jobStatus is the public view of a job, without the runbook snapshot and
+// request input which may contain secrets.
+type jobStatus struct {
+	ID       string           `json:"id"`
+	Hook     string           `json:"hook"`
+	ReplayOf string           `json:"replayOf,omitempty"`
+	State    jobState         `json:"state"`
+	Created  time.Time        `json:"created"`
+	Started  *time.Time       `json:"started,omitempty"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Response *runBookResponse `json:"response,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+func (j *job) status() jobStatus {
+	s := jobStatus{
+		ID:       j.ID,
+		Hook:     j.Hook,
+		ReplayOf: j.ReplayOf,
+		State:    j.State,
+		Created:  j.Created,
+		Response: j.Response,
+		Error:    j.Error,
+	}
+	if !j.Started.IsZero() {
+		started := j.Started
+		s.Started = &started
+	}
+	if !j.Finished.IsZero() {
+		finished := j.Finished
+		s.Finished = &finished
+	}
+	return s
+}
+
+func (j *job) done() bool {
+	return j.State != jobQueued && j.State != jobRunning
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102-150405"), hex.EncodeToString(b)), nil
+}
+
+// jobQueue runs jobs on a fixed pool of workers. When dir is set every
+// state change is written to disk before it is acted upon.
+type jobQueue struct {
+	dir     string
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*job
+	jobs    map[string]*job
+	order   []string
+	last    map[string]jobStatus
+	// finished indexes the latest finished jobs on disk, oldest first, so
+	// that recent need not read them.
+	finished []jobStatus
+	stopped  bool
+	workers  sync.WaitGroup
+}
+
+func newJobQueue(dir string, workers int) (*jobQueue, error) {
+	q := &jobQueue{
+		dir:  dir,
+		jobs: make(map[string]*job),
+		last: make(map[string]jobStatus),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q, nil
+}
+
+// create persists a new job for rb. The job is on disk by the time create
+// returns. replayOf links the job to the one it replays, if any; async is
+// set if the caller does not wait for the job.
+func (q *jobQueue) create(rb *runBook, in input, replayOf string, async bool) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		ID:       id,
+		Hook:     rb.ID,
+		ReplayOf: replayOf,
+		Async:    async,
+		State:    jobQueued,
+		RunBook:  rb,
+		Input:    in,
+		Created:  time.Now().UTC(),
+	}
+	if err := q.save(j); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	q.track(j)
+	q.recordLast(j)
+	q.mu.Unlock()
+	return j, nil
+}
+
+// enqueue hands j to the workers.
+func (q *jobQueue) enqueue(j *job) {
+	q.mu.Lock()
+	q.pending = append(q.pending, j)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// submit persists a new job for rb and queues it.
+func (q *jobQueue) submit(rb *runBook, in input) (*job, error) {
+	j, err := q.create(rb, in, "", true)
+	if err != nil {
+		return nil, err
+	}
+	q.enqueue(j)
+	return j, nil
+}
+
+// replay creates a new job with the recorded input of the job identified by
+// id. The original runbook snapshot is used unless current is set, in which
+// case the runbook is loaded again from the configdir.
+func (q *jobQueue) replay(id string, current bool) (*job, error) {
+	orig, err := q.get(id)
+	if err != nil {
+		return nil, err
+	}
+	rb, err := orig.replayRunBook(current)
+	if err != nil {
+		return nil, err
+	}
+	return q.create(rb, orig.replayInput(rb), orig.ID, true)
+}
+
+// replayInput returns the input a replay of j under rb is run with. Credential
+// headers are redacted whether or not j was loaded from disk, so a replay
+// never carries them.
+func (j *job) replayInput(rb *runBook) input {
+	return j.Input.scrubbed(j.RunBook).scrubbed(rb)
+}
+
+// replayRunBook returns the runbook a replay of j should use.
+func (j *job) replayRunBook(current bool) (*runBook, error) {
+	if current {
+		return NewRunBook(j.Hook)
+	}
+	if j.RunBook == nil {
+		return nil, fmt.Errorf("job '%s' has no runbook", j.ID)
+	}
+	rb := *j.RunBook
+	return &rb, nil
+}
+
+// track must be called with q.mu held. Finished jobs are dropped once they
+// are on disk; without a data dir only the most recent ones are kept.
+func (q *jobQueue) track(j *job) {
+	if _, ok := q.jobs[j.ID]; !ok && q.dir == "" {
+		q.order = append(q.order, j.ID)
+	}
+	q.jobs[j.ID] = j
+	if len(q.order) <= maxMemoryJobs {
+		return
+	}
+	for i, id := range q.order {
+		if old := q.jobs[id]; old.done() {
+			delete(q.jobs, id)
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// get returns a copy of the job identified by id.
+func (q *jobQueue) get(id string) (*job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.jobs[id]; ok {
+		cp := *j
+		return &cp, nil
+	}
+	if q.dir == "" {
+		return nil, fmt.Errorf("job '%s' not found", id)
+	}
+	return q.load(id)
+}
+
+func (q *jobQueue) load(id string) (*job, error) {
+	if strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("job '%s' not found", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, id+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("job '%s' not found", id)
+	}
+	j := new(job)
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	if j.RunBook != nil {
+		j.RunBook.ID = j.Hook
+		j.RunBook = j.restoreSecrets()
+	}
+	if j.RunBook != nil {
+		if err := j.RunBook.compileRedact(); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// storedRunBook returns the copy of rb that is written to disk with a job,
+// with its credentials and every known secret redacted.
+func storedRunBook(rb *runBook) (*runBook, error) {
+	if rb == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(rb)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(redactSettings(settings)); err != nil {
+		return nil, err
+	}
+	stored := &runBook{ID: rb.ID}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// restoreSecrets returns the runbook of j, which was loaded from disk, with
+// the credentials of the hook's current runbook in place of the redacted
+// ones. If anything else was redacted the current runbook is used as a
+// whole. Without a current runbook the job has none.
+func (j *job) restoreSecrets() *runBook {
+	if !containsRedacted(j.RunBook) {
+		return j.RunBook
+	}
+	current, err := getRunBookById(j.Hook)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":  j.Hook,
+			"job":   j.ID,
+			"error": err,
+		}).Warn("Could not restore the secrets of a stored job!")
+		return nil
+	}
+	rb := *j.RunBook
+	rb.Auth = current.Auth
+	if rb.Signature != nil {
+		sig := *rb.Signature
+		sig.Secret = nil
+		if current.Signature != nil {
+			sig.Secret = current.Signature.Secret
+		}
+		rb.Signature = &sig
+	}
+	if containsRedacted(&rb) {
+		return current
+	}
+	return &rb
+}
+
+func containsRedacted(rb *runBook) bool {
+	data, err := json.Marshal(rb)
+	return err != nil || bytes.Contains(data, []byte(redacted))
+}
+
+// save writes j to disk and waits for it to be flushed.
+func (q *jobQueue) save(j *job) error {
+	if q.dir == "" {
+		return nil
+	}
+	stored := *j
+	stored.Input = j.Input.scrubbed(j.RunBook)
+	rb, err := storedRunBook(j.RunBook)
+	if err != nil {
+		return err
+	}
+	stored.RunBook = rb
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(q.dir, ".tmp-"+j.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(q.dir, j.ID+".json")); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// recover loads the jobs left unfinished by a previous process. Jobs that
+// never started are queued again; jobs that were running are resumed or
+// marked interrupted according to their runbook's onRestart policy.
+func (q *jobQueue) recover() error {
+	if q.dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".json")
+		j, err := q.load(id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"job":   id,
+				"error": err,
+			}).Error("Failed to load job!")
+			continue
+		}
+		if j.done() {
+			q.mu.Lock()
+			q.recordLast(j)
+			q.recordFinished(j)
+			q.mu.Unlock()
+			continue
+		}
+		// A caller waiting on a job has had an error by now and may have
+		// tried again.
+		if !j.Async || j.State == jobRunning && (j.RunBook == nil || j.RunBook.OnRestart != onRestartResume) {
+			j.State = jobInterrupted
+			j.Finished = time.Now().UTC()
+			j.Error = "interrupted by restart"
+			if err := q.save(j); err != nil {
+				return err
+			}
+			q.mu.Lock()
+			q.recordFinished(j)
+			q.mu.Unlock()
+			log.WithFields(log.Fields{
+				"hook": j.Hook,
+				"job":  j.ID,
+			}).Warn("Job was interrupted by a restart.")
+			continue
+		}
+		j.State = jobQueued
+		q.mu.Lock()
+		q.track(j)
+		q.mu.Unlock()
+		q.enqueue(j)
+		log.WithFields(log.Fields{
+			"hook": j.Hook,
+			"job":  j.ID,
+		}).Info("Resuming unfinished job.")
+	}
+	return nil
+}
+
+func (q *jobQueue) next() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if q.stopped {
+		return nil
+	}
+	j := q.pending[0]
+	q.pending = q.pending[1:]
+	return j
+}
+
+// recordLast must be called with q.mu held. It remembers j as the latest
+// run of its hook, unless a later one is known.
+func (q *jobQueue) recordLast(j *job) {
+	if last, ok := q.last[j.Hook]; ok && last.ID != j.ID && last.Created.After(j.Created) {
+		return
+	}
+	s := j.status()
+	s.Response = nil
+	q.last[j.Hook] = s
+}
+
+// recordFinished must be called with q.mu held. It adds j, which is finished
+// and on disk, to the index of finished jobs. Jobs are created in order but
+// may finish in any.
+func (q *jobQueue) recordFinished(j *job) {
+	s := j.status()
+	s.Response = nil
+	i := sort.Search(len(q.finished), func(i int) bool {
+		return q.finished[i].Created.After(s.Created)
+	})
+	q.finished = append(q.finished, jobStatus{})
+	copy(q.finished[i+1:], q.finished[i:])
+	q.finished[i] = s
+	if over := len(q.finished) - maxMemoryJobs; over > 0 {
+		q.finished = append(q.finished[:0], q.finished[over:]...)
+	}
+}
+
+// recent returns the latest jobs, of hook or of every hook if it is empty,
+// newest first and without their output. Of the finished jobs on disk only
+// the latest maxMemoryJobs are known.
+func (q *jobQueue) recent(hook string, limit int) []jobStatus {
+	q.mu.Lock()
+	var list []jobStatus
+	seen := make(map[string]bool, len(q.jobs))
+	for _, j := range q.jobs {
+		if hook == "" || j.Hook == hook {
+			s := j.status()
+			s.Response = nil
+			list = append(list, s)
+			seen[j.ID] = true
+		}
+	}
+	done := 0
+	for i := len(q.finished) - 1; i >= 0 && done < limit; i-- {
+		s := q.finished[i]
+		if seen[s.ID] || hook != "" && s.Hook != hook {
+			continue
+		}
+		list = append(list, s)
+		done++
+	}
+	q.mu.Unlock()
+	sort.Sort(byCreated(list))
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// byCreated sorts jobs newest first.
+type byCreated []jobStatus
+
+func (l byCreated) Len() int           { return len(l) }
+func (l byCreated) Less(i, j int) bool { return l[i].Created.After(l[j].Created) }
+func (l byCreated) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// lastRun returns the status, without output, of the latest run of hook.
+func (q *jobQueue) lastRun(hook string) *jobStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s, ok := q.last[hook]; ok {
+		return &s
+	}
+	return nil
+}
+
+func (q *jobQueue) update(j *job, fn func(*job)) {
+	q.mu.Lock()
+	fn(j)
+	q.recordLast(j)
+	cp := *j
+	q.mu.Unlock()
+	if err := q.save(&cp); err != nil {
+		log.WithFields(log.Fields{
+			"hook":  j.Hook,
+			"job":   j.ID,
+			"error": err,
+		}).Error("Failed to save job!")
+		return
+	}
+	if q.dir != "" && cp.done() {
+		q.mu.Lock()
+		q.recordFinished(&cp)
+		delete(q.jobs, j.ID)
+		q.mu.Unlock()
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.workers.Done()
+	for j := q.next(); j != nil; j = q.next() {
+		q.run(j)
+	}
+}
+
+// stop has the workers exit once they are done with the jobs they are
+// running, and waits for them. Jobs still queued are left for a restart.
+func (q *jobQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+	q.workers.Wait()
+}
+
+// run executes j once its hook has a free slot.
+func (q *jobQueue) run(j *job) {
+	if j.RunBook != nil {
+		slots.acquire(j.Hook, j.RunBook.Concurrency, true)
+		defer slots.release(j.Hook)
+	}
+	q.process(j)
+}
+
+// process executes j right away. Callers are responsible for holding a slot.
+func (q *jobQueue) process(j *job) {
+	if j.RunBook == nil {
+		q.update(j, func(j *job) {
+			j.State = jobFailed
+			j.Finished = time.Now().UTC()
+			j.Error = "job has no runbook"
+		})
+		return
+	}
+	q.update(j, func(j *job) {
+		j.State = jobRunning
+		j.Started = time.Now().UTC()
+	})
+	log.WithFields(log.Fields{
+		"hook":        j.Hook,
+		"job":         j.ID,
+		"num_scripts": len(j.RunBook.Scripts),
+	}).Info("Executing job.")
+
+	response, err := j.RunBook.execute(j.Input)
+	j.RunBook.redactResponse(response)
+	q.update(j, func(j *job) {
+		j.Finished = time.Now().UTC()
+		j.Response = response
+		switch {
+		case err != nil:
+			j.State = jobFailed
+			j.Error = j.RunBook.redact(err.Error())
+		case !response.ok():
+			j.State = jobFailed
+		default:
+			j.State = jobSucceeded
+		}
+	})
+	log.WithFields(log.Fields{
+		"hook":  j.Hook,
+		"job":   j.ID,
+		"state": j.State,
+		"time":  j.RunBook.ExecTime,
+	}).Info("Job complete.")
+	audit.write(&auditRecord{
+		Event:    auditJob,
+		Hook:     j.Hook,
+		Job:      j.ID,
+		ReplayOf: j.ReplayOf,
+		Outcome:  string(j.State),
+		Reason:   j.Error,
+	})
+}
+
+// hookSlots limits the number of jobs running at once for each hook.
+type hookSlots struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running map[string]int
+}
+
+var slots = newHookSlots()
+
+func newHookSlots() *hookSlots {
+	s := &hookSlots{running: make(map[string]int)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire takes a slot for hook id, which may have at most limit jobs
+// running at once; a limit below 1 means no limit. If wait is false and no
+// slot is free acquire returns false right away.
+func (s *hookSlots) acquire(id string, limit int, wait bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for limit > 0 && s.running[id] >= limit {
+		if !wait {
+			return false
+		}
+		s.cond.Wait()
+	}
+	s.running[id]++
+	return true
+}
+
+func (s *hookSlots) release(id string) {
+	s.mu.Lock()
+	s.running[id]--
+	if s.running[id] <= 0 {
+		delete(s.running, id)
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
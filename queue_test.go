@@ -0,0 +1,424 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+var asyncScript = `
+{
+  "async": true,
+  "scripts": [
+    {
+      "command": "echo",
+      "args": [
+        "foo"
+      ]
+    }
+  ]
+}`
+
+// waitForJob waits for the job to be finished, on disk if q has a dir.
+func waitForJob(t *testing.T, q *jobQueue, id string) *job {
+  get := q.get
+  if q.dir != "" {
+    get = q.load
+  }
+  for i := 0; i < 100; i++ {
+    j, err := get(id)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if j.done() {
+      return j
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Fatalf("job %s did not finish", id)
+  return nil
+}
+
+func TestAsyncHookIsQueued(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  if err := ioutil.WriteFile(filepath.Join(dir, "async.json"), []byte(asyncScript), 0644); err != nil {
+    t.Fatal(err)
+  }
+  queue, err = newJobQueue(filepath.Join(dir, "jobs"), 1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer queue.stop()
+
+  r := mux.NewRouter()
+  r.HandleFunc("/jobs/{id}", jobHandler).Methods("GET")
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  resp, err := http.Post(ts.URL+"/async", "application/json", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusAccepted {
+    t.Fatalf("wanted %d, got %d", http.StatusAccepted, resp.StatusCode)
+  }
+  var accepted map[string]string
+  if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := os.Stat(filepath.Join(dir, "jobs", accepted["id"]+".json")); err != nil {
+    t.Errorf("job was not persisted: %v", err)
+  }
+
+  j := waitForJob(t, queue, accepted["id"])
+  if j.State != jobSucceeded {
+    t.Errorf("wanted state %s, got %s", jobSucceeded, j.State)
+  }
+  if j.Response == nil || j.Response.Results[0].Stdout != "foo\n" {
+    t.Errorf("unexpected response: %+v", j.Response)
+  }
+
+  resp, err = http.Get(ts.URL + resp.Header.Get("Location"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer resp.Body.Close()
+  var status jobStatus
+  if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+    t.Fatal(err)
+  }
+  if status.ID != j.ID || status.State != jobSucceeded {
+    t.Errorf("unexpected job status: %+v", status)
+  }
+}
+
+func TestJobInputScrubbed(t *testing.T) {
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  q, err := newJobQueue(dir, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  redactions.addSecret("interpolated-secret")
+  rb := &runBook{
+    ID:        "scrub",
+    Auth:      credentials{{Token: "s3cr3t-value-xyz", Scheme: schemeHeader, Header: "X-Deploy-Key"}},
+    Signature: &signatureConfig{Scheme: sigGitHub, Secret: credentials{{Token: "hmac-secret-abc"}}},
+    Env:       map[string]string{"API_KEY": "interpolated-secret"},
+  }
+  headers := map[string]string{
+    "Authorization": "Bearer in-authorization",
+    "X-Deploy-Key":  "in-deploy-key",
+    "User-Agent":    "curl",
+  }
+  h, _ := json.Marshal(headers)
+  in := input{Headers: headers, Body: []byte(`{}`), Stdin: append(append(h, '\n'), `{}`...)}
+  j, err := q.create(rb, in, "", false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if j.Input.Headers["Authorization"] != "Bearer in-authorization" {
+    t.Errorf("input of the running job was scrubbed: %v", j.Input.Headers)
+  }
+
+  data, err := ioutil.ReadFile(filepath.Join(dir, j.ID+".json"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, secret := range []string{"in-authorization", "in-deploy-key", "s3cr3t-value-xyz", "hmac-secret-abc", "interpolated-secret"} {
+    if bytes.Contains(data, []byte(secret)) {
+      t.Errorf("%s was stored: %s", secret, data)
+    }
+  }
+  configdir = filepath.Join(dir, "config")
+  stored, err := q.load(j.ID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if stored.Input.Headers["User-Agent"] != "curl" || stored.Input.Headers["Authorization"] != redacted || !bytes.HasSuffix(stored.Input.Stdin, []byte("\n{}")) {
+    t.Errorf("unexpected stored input: %+v", stored.Input)
+  }
+  // Without the hook its secrets cannot be restored, so neither can the
+  // runbook.
+  if stored.RunBook != nil {
+    t.Errorf("runbook with redacted secrets was loaded: %+v", stored.RunBook)
+  }
+
+  // Otherwise they are read again from the current runbook.
+  os.Mkdir(configdir, 0755)
+  ioutil.WriteFile(filepath.Join(configdir, "scrub.json"), []byte(`{"auth": "s3cr3t-value-xyz", "env": {"API_KEY": "current-secret"}, "scripts": []}`), 0644)
+  if stored, err = q.load(j.ID); err != nil {
+    t.Fatal(err)
+  }
+  if stored.RunBook == nil || stored.RunBook.Auth[0].Token != "s3cr3t-value-xyz" || stored.RunBook.Env["API_KEY"] != "current-secret" {
+    t.Errorf("secrets were not restored: %+v", stored.RunBook)
+  }
+}
+
+func TestJobRecovery(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  // A queue with no workers stands in for a process that died.
+  old := &jobQueue{dir: dir, jobs: make(map[string]*job)}
+  rb := &runBook{ID: "test", Scripts: []script{{Command: "echo", Args: []string{"foo"}}}}
+  resume := &runBook{ID: "test", Scripts: rb.Scripts, OnRestart: onRestartResume}
+
+  tests := []struct {
+    rb    *runBook
+    async bool
+    state jobState
+    want  jobState
+  }{
+    {rb, true, jobQueued, jobSucceeded},
+    {rb, true, jobRunning, jobInterrupted},
+    {resume, true, jobRunning, jobSucceeded},
+    // Sync and scheduled jobs are not run again.
+    {rb, false, jobQueued, jobInterrupted},
+    {resume, false, jobRunning, jobInterrupted},
+  }
+  ids := make([]string, len(tests))
+  for i, tt := range tests {
+    id, err := newJobID()
+    if err != nil {
+      t.Fatal(err)
+    }
+    ids[i] = id
+    j := &job{ID: id, Hook: tt.rb.ID, Async: tt.async, State: tt.state, RunBook: tt.rb, Created: time.Now()}
+    if err := old.save(j); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  q, err := newJobQueue(dir, 1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer q.stop()
+  if err := q.recover(); err != nil {
+    t.Fatal(err)
+  }
+  for i, tt := range tests {
+    j := waitForJob(t, q, ids[i])
+    if j.State != tt.want {
+      t.Errorf("job in state %s with policy %q, async %v: wanted %s, got %s", tt.state, tt.rb.OnRestart, tt.async, tt.want, j.State)
+    }
+  }
+}
+
+func TestRecentIndex(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  old := &jobQueue{dir: dir, jobs: make(map[string]*job)}
+  now := time.Now().UTC()
+  for i, hook := range []string{"a", "b", "a"} {
+    j := &job{ID: fmt.Sprintf("job-%d", i), Hook: hook, State: jobSucceeded, Created: now.Add(time.Duration(i) * time.Second)}
+    if err := old.save(j); err != nil {
+      t.Fatal(err)
+    }
+  }
+  q, err := newJobQueue(dir, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := q.recover(); err != nil {
+    t.Fatal(err)
+  }
+  // The list is served from memory.
+  files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+  for _, f := range files {
+    os.Remove(f)
+  }
+  tests := []struct {
+    hook  string
+    limit int
+    ids   string
+  }{
+    {"", 10, "job-2 job-1 job-0"},
+    {"a", 10, "job-2 job-0"},
+    {"", 2, "job-2 job-1"},
+    {"c", 10, ""},
+  }
+  for _, tt := range tests {
+    var ids []string
+    for _, s := range q.recent(tt.hook, tt.limit) {
+      ids = append(ids, s.ID)
+    }
+    if strings.Join(ids, " ") != tt.ids {
+      t.Errorf("recent(%q, %d): wanted %q, got %q", tt.hook, tt.limit, tt.ids, ids)
+    }
+  }
+
+  // The index is bounded and kept in order of creation.
+  q.mu.Lock()
+  for i := 0; i < maxMemoryJobs; i++ {
+    q.recordFinished(&job{ID: fmt.Sprintf("more-%d", i), Hook: "c", Created: now.Add(time.Duration(10+i) * time.Second)})
+  }
+  q.recordFinished(&job{ID: "late", Hook: "c", Created: now.Add(510*time.Second + time.Millisecond)})
+  n := len(q.finished)
+  q.mu.Unlock()
+  if n != maxMemoryJobs {
+    t.Errorf("index holds %d jobs", n)
+  }
+  if list := q.recent("a", 10); len(list) != 0 {
+    t.Errorf("oldest jobs were not dropped: %v", list)
+  }
+  if list := q.recent("c", maxMemoryJobs); list[499].ID != "late" {
+    t.Errorf("job finished out of order was misplaced: %v", list[499])
+  }
+}
+
+func TestReplay(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  echo = false
+  rbPath := filepath.Join(dir, "replay.json")
+  if err := ioutil.WriteFile(rbPath, []byte(exposePostHandlerScript), 0644); err != nil {
+    t.Fatal(err)
+  }
+  queue, err = newJobQueue(filepath.Join(dir, "jobs"), 1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer queue.stop()
+
+  r := mux.NewRouter()
+  r.HandleFunc("/jobs/{id}/replay", replayHandler).Methods("POST")
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  resp, err := http.Post(ts.URL+"/replay", "application/json", bytes.NewBufferString("payload"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  resp.Body.Close()
+  files, _ := filepath.Glob(filepath.Join(dir, "jobs", "*.json"))
+  if len(files) != 1 {
+    t.Fatalf("wanted 1 recorded job, got %d", len(files))
+  }
+  origID := strings.TrimSuffix(filepath.Base(files[0]), ".json")
+  orig := waitForJob(t, queue, origID)
+
+  // The current runbook differs from the recorded one.
+  if err := ioutil.WriteFile(rbPath, []byte(hookHandlerScript), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    query string
+    want  string
+  }{
+    {"", orig.Response.Results[0].Stdout},
+    {"?current=1", "foo\n"},
+  }
+  for _, tt := range tests {
+    resp, err := http.Post(ts.URL+"/jobs/"+origID+"/replay"+tt.query, "", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if resp.StatusCode != http.StatusAccepted {
+      t.Fatalf("wanted %d, got %d", http.StatusAccepted, resp.StatusCode)
+    }
+    var accepted map[string]string
+    if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+
+    j := waitForJob(t, queue, accepted["id"])
+    if j.ReplayOf != origID {
+      t.Errorf("replay%s: wanted replayOf %s, got %s", tt.query, origID, j.ReplayOf)
+    }
+    if got := j.Response.Results[0].Stdout; got != tt.want {
+      t.Errorf("replay%s: wanted %q, got %q", tt.query, tt.want, got)
+    }
+  }
+}
+
+func TestReplayScrubsCredentials(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  // Loading the job from disk restores the token from the runbook.
+  rbJSON := `{"auth": [{"token": "s3cr3t", "scheme": "header", "header": "X-Deploy-Key"}], "scripts": []}`
+  if err := ioutil.WriteFile(filepath.Join(dir, "creds.json"), []byte(rbJSON), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  rb := &runBook{ID: "creds", Auth: credentials{{Token: "s3cr3t", Scheme: schemeHeader, Header: "X-Deploy-Key"}}}
+  in := input{Headers: map[string]string{"Authorization": "Bearer abc", "X-Deploy-Key": "s3cr3t", "X-Other": "kept"}}
+  q, err := newJobQueue(filepath.Join(dir, "jobs"), 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  orig, err := q.create(rb, in, "", false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // A fresh queue only finds the job on disk.
+  fromDisk, err := newJobQueue(filepath.Join(dir, "jobs"), 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for name, q := range map[string]*jobQueue{"in memory": q, "on disk": fromDisk} {
+    j, err := q.replay(orig.ID, false)
+    if err != nil {
+      t.Fatalf("%s: %s", name, err)
+    }
+    for _, h := range []string{"Authorization", "X-Deploy-Key"} {
+      if got := j.Input.Headers[h]; got != redacted {
+        t.Errorf("%s: wanted %s redacted in the replay, got %q", name, h, got)
+      }
+    }
+    if got := j.Input.Headers["X-Other"]; got != "kept" {
+      t.Errorf("%s: wanted X-Other kept, got %q", name, got)
+    }
+  }
+}
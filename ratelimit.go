@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	limitByHook       = "hook"
+	limitByClient     = "client"
+	limitByHookClient = "hook+client"
+
+	// sweepInterval is how often buckets that have refilled are dropped.
+	sweepInterval = 10 * time.Minute
+)
+
+// rateLimit is a token bucket configuration. Rate is given as "N/duration",
+// e.g. "10/1m"; Burst defaults to N.
+type rateLimit struct {
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst,omitempty"`
+	By    string `json:"by,omitempty"`
+
+	perSecond float64
+}
+
+// parse validates the limit and works out its rate.
+func (l *rateLimit) parse() error {
+	parts := strings.SplitN(l.Rate, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("rate limit '%s' must look like 10/1m", l.Rate)
+	}
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("rate limit '%s' must look like 10/1m", l.Rate)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return fmt.Errorf("rate limit '%s' must look like 10/1m", l.Rate)
+	}
+	switch l.By {
+	case "", limitByHook, limitByClient, limitByHookClient:
+	default:
+		return fmt.Errorf("rate limit by '%s' must be hook, client or hook+client", l.By)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("rate limit burst must not be negative")
+	}
+	l.perSecond = n / per.Seconds()
+	if l.Burst == 0 {
+		l.Burst = int(math.Max(1, math.Ceil(n)))
+	}
+	return nil
+}
+
+// key returns the bucket a request for hook from client goes in. scope keeps
+// the buckets of the global limit apart from those of runbooks.
+func (l *rateLimit) key(scope, hook, client string) string {
+	switch l.By {
+	case limitByHook:
+		return scope + "|" + hook + "|"
+	case limitByClient:
+		return scope + "||" + client
+	}
+	return scope + "|" + hook + "|" + client
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled to its burst.
+	full time.Time
+}
+
+// rateLimiter holds the token buckets of all limits.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+// limiter is shared by all hooks; globalRateLimit applies to hooks without
+// a rateLimit of their own.
+var (
+	limiter         = newRateLimiter()
+	globalRateLimit *rateLimit
+)
+
+// allow takes a token from the bucket for key. If there is none it returns
+// false and how long until there will be.
+func (rl *rateLimiter) allow(l *rateLimit, key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) > sweepInterval {
+		rl.sweep(now)
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.perSecond)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	refill := (float64(l.Burst) - b.tokens) / l.perSecond
+	b.full = now.Add(time.Duration(refill * float64(time.Second)))
+	if allowed {
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have refilled since they were last used. A new
+// bucket starts full, so dropping them changes nothing however slow the rate.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for k, b := range rl.buckets {
+		if !now.Before(b.full) {
+			delete(rl.buckets, k)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// rateLimitFor returns the limit that applies to rb and the scope of its
+// buckets, or nil if there is none.
+func rateLimitFor(rb *runBook) (*rateLimit, string) {
+	if rb.RateLimit != nil {
+		return rb.RateLimit, "hook:" + rb.ID
+	}
+	return globalRateLimit, "global"
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+func TestTokenBucket(t *testing.T) {
+  l := &rateLimit{Rate: "2/1s", Burst: 3}
+  if err := l.parse(); err != nil {
+    t.Fatal(err)
+  }
+  rl := newRateLimiter()
+  now := time.Now()
+
+  tests := []struct {
+    after time.Duration
+    ok    bool
+    wait  time.Duration
+  }{
+    {0, true, 0},
+    {0, true, 0},
+    {0, true, 0},
+    {0, false, 500 * time.Millisecond},
+    {250 * time.Millisecond, false, 250 * time.Millisecond},
+    {250 * time.Millisecond, true, 0},
+    {0, false, 500 * time.Millisecond},
+    {time.Minute, true, 0},
+  }
+  for i, tt := range tests {
+    now = now.Add(tt.after)
+    ok, wait := rl.allow(l, "k", now)
+    if ok != tt.ok || wait != tt.wait {
+      t.Errorf("request %d: wanted (%v, %v), got (%v, %v)", i, tt.ok, tt.wait, ok, wait)
+    }
+  }
+
+  for _, rate := range []string{"", "10", "0/1s", "10/0s", "x/1m"} {
+    if err := (&rateLimit{Rate: rate}).parse(); err == nil {
+      t.Errorf("rate %q unexpectedly parsed", rate)
+    }
+  }
+  if err := (&rateLimit{Rate: "1/1s", By: "path"}).parse(); err == nil {
+    t.Errorf("by path unexpectedly parsed")
+  }
+}
+
+func TestSweepSlowRate(t *testing.T) {
+  l := &rateLimit{Rate: "1/1h"}
+  if err := l.parse(); err != nil {
+    t.Fatal(err)
+  }
+  rl := newRateLimiter()
+  now := time.Now()
+
+  if ok, _ := rl.allow(l, "k", now); !ok {
+    t.Fatal("first request was refused")
+  }
+  // Well past the sweep interval but before the bucket has refilled.
+  now = now.Add(30 * time.Minute)
+  rl.sweep(now)
+  if ok, _ := rl.allow(l, "k", now); ok {
+    t.Error("empty bucket was swept and the limit reset")
+  }
+  now = now.Add(2 * time.Hour)
+  rl.sweep(now)
+  if len(rl.buckets) != 0 {
+    t.Errorf("refilled bucket was kept: %v", rl.buckets)
+  }
+}
+
+func TestRateLimitedHook(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  queue, _ = newJobQueue("", 0)
+  script := `{"rateLimit": {"rate": "1/1h", "by": "hook"}, "scripts": [{"command": "true"}]}`
+  ioutil.WriteFile(filepath.Join(dir, "limited.json"), []byte(script), 0644)
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  for i, want := range []int{200, 429} {
+    resp, err := http.Post(ts.URL+"/limited", "", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != want {
+      t.Errorf("request %d: wanted %d, got %d", i, want, resp.StatusCode)
+    }
+    if want == 429 && resp.Header.Get("Retry-After") != "3600" {
+      t.Errorf("wanted Retry-After 3600, got %q", resp.Header.Get("Retry-After"))
+    }
+  }
+  if got := throttledByHook.Get("limited").String(); got != "1" {
+    t.Errorf("wanted 1 throttled request, got %s", got)
+  }
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	redacted = "[REDACTED]"
+
+	// minSecretLength keeps very short secrets from blanking out unrelated
+	// text.
+	minSecretLength = 4
+)
+
+// builtinRedactions hide credentials wherever they turn up: the values of
+// headers that carry them in the JSON handed to scripts, and bearer and
+// basic credentials in any other form.
+var builtinRedactions = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)"(?:authorization|proxy-authorization|cookie|x-hook-token|x-captainhook-admin-token)"\s*:\s*"((?:[^"\\]|\\.)*)"`),
+	regexp.MustCompile(`(?i)\b(?:bearer|basic)\s+([A-Za-z0-9._~+/=-]+)`),
+}
+
+// redactor removes secrets from text before it is logged, stored or sent
+// back to a caller. It knows the secret values captainhook has read, and
+// the patterns each runbook asks for so that its log lines can be redacted.
+type redactor struct {
+	mu      sync.RWMutex
+	secrets map[string]bool
+	hooks   map[string][]*regexp.Regexp
+}
+
+var redactions = &redactor{
+	secrets: make(map[string]bool),
+	hooks:   make(map[string][]*regexp.Regexp),
+}
+
+// addSecret makes sure s is never shown.
+func (r *redactor) addSecret(s string) {
+	if len(s) < minSecretLength {
+		return
+	}
+	r.mu.RLock()
+	known := r.secrets[s]
+	r.mu.RUnlock()
+	if known {
+		return
+	}
+	r.mu.Lock()
+	r.secrets[s] = true
+	r.mu.Unlock()
+}
+
+// setHookPatterns replaces the patterns redacted from the log lines of hook
+// id.
+func (r *redactor) setHookPatterns(id string, patterns []*regexp.Regexp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(patterns) == 0 {
+		delete(r.hooks, id)
+		return
+	}
+	r.hooks[id] = patterns
+}
+
+// compilePatterns compiles the redact patterns of a runbook.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern '%s': %v", p, err)
+		}
+		compiled[i] = re
+	}
+	return compiled, nil
+}
+
+// redactMatches replaces the matches of re in s, or their groups if re has
+// any.
+func redactMatches(re *regexp.Regexp, s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		spans := [][]int{m[:2]}
+		if len(m) > 2 {
+			spans = nil
+			for i := 2; i+1 < len(m); i += 2 {
+				if m[i] >= 0 {
+					spans = append(spans, m[i:i+2])
+				}
+			}
+		}
+		for _, span := range spans {
+			if span[0] < last {
+				continue
+			}
+			b.WriteString(s[last:span[0]])
+			b.WriteString(redacted)
+			last = span[1]
+		}
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// redact returns s with every known secret replaced, and the matches of
+// patterns if any are given.
+func (r *redactor) redact(s string, patterns ...*regexp.Regexp) string {
+	if s == "" {
+		return s
+	}
+	for _, re := range builtinRedactions {
+		s = redactMatches(re, s)
+	}
+	r.mu.RLock()
+	for secret := range r.secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	r.mu.RUnlock()
+	for _, re := range patterns {
+		s = redactMatches(re, s)
+	}
+	return s
+}
+
+// redactHook is redact with the patterns of hook id.
+func (r *redactor) redactHook(id, s string) string {
+	r.mu.RLock()
+	patterns := r.hooks[id]
+	r.mu.RUnlock()
+	return r.redact(s, patterns...)
+}
+
+// compileRedact compiles the runbook's redact patterns and has its log
+// lines redacted with them. Patterns only ever apply to their own hook.
+func (r *runBook) compileRedact() error {
+	patterns, err := compilePatterns(r.Redact)
+	if err != nil {
+		return err
+	}
+	r.redactPatterns = patterns
+	if r.ID != "" {
+		redactions.setHookPatterns(r.ID, patterns)
+	}
+	return nil
+}
+
+// redact returns s with every known secret and the runbook's own patterns
+// replaced.
+func (r *runBook) redact(s string) string {
+	return redactions.redact(s, r.redactPatterns...)
+}
+
+// redactResponse redacts script output in place.
+func (r *runBook) redactResponse(resp *runBookResponse) {
+	if resp == nil {
+		return
+	}
+	for i := range resp.Results {
+		resp.Results[i].Stdout = r.redact(resp.Results[i].Stdout)
+		resp.Results[i].Stderr = r.redact(resp.Results[i].Stderr)
+	}
+}
+
+// redactPlan redacts the arguments and environment of resolved scripts in
+// place.
+func (r *runBook) redactPlan(plan []resolvedScript) {
+	for i := range plan {
+		for j, arg := range plan[i].Args {
+			plan[i].Args[j] = r.redact(arg)
+		}
+		for j, env := range plan[i].Env {
+			plan[i].Env[j] = r.redact(env)
+		}
+	}
+}
+
+// secretSettings are the runbook keys whose string values are secrets. A
+// string under auth is a token.
+var secretSettings = map[string]bool{
+	"auth":   true,
+	"token":  true,
+	"secret": true,
+}
+
+// redactSettings returns a copy of runbook settings with secret values
+// replaced.
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		out[k] = redactSetting(k, v)
+	}
+	return out
+}
+
+func redactSetting(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return redactSettings(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, x := range v {
+			out[i] = redactSetting(key, x)
+		}
+		return out
+	case string:
+		if secretSettings[key] {
+			return redacted
+		}
+		return redactions.redact(v)
+	}
+	return v
+}
+
+// redactingFormatter redacts log messages and fields before handing them
+// to the formatter that writes them.
+type redactingFormatter struct {
+	log.Formatter
+}
+
+func (f redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	hook, _ := entry.Data["hook"].(string)
+	e := *entry
+	e.Message = redactions.redactHook(hook, entry.Message)
+	e.Data = make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			e.Data[k] = redactions.redactHook(hook, v)
+		case error:
+			e.Data[k] = redactions.redactHook(hook, v.Error())
+		case fmt.Stringer:
+			e.Data[k] = redactions.redactHook(hook, v.String())
+		default:
+			e.Data[k] = v
+		}
+	}
+	return f.Formatter.Format(&e)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+  r := &redactor{secrets: make(map[string]bool), hooks: make(map[string][]*regexp.Regexp)}
+  r.addSecret("hunter22")
+  r.addSecret("abc")
+  patterns, err := compilePatterns([]string{`card=(\d+)`, `ssn-\d{3}`})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := compilePatterns([]string{`(`}); err == nil {
+    t.Errorf("bad pattern unexpectedly compiled")
+  }
+
+  tests := []struct {
+    in   string
+    want string
+  }{
+    {`{"Authorization":"Basic Og==","User-Agent":"curl"}`, `{"Authorization":"[REDACTED]","User-Agent":"curl"}`},
+    {`{"x-hook-token": "t\"ok"}`, `{"x-hook-token": "[REDACTED]"}`},
+    {`Authorization: Bearer eyJhbGciOi.x.y`, `Authorization: Bearer [REDACTED]`},
+    {`password is hunter22!`, `password is [REDACTED]!`},
+    {`abc is too short to be a secret`, `abc is too short to be a secret`},
+    {`paid with card=4111111111111111 ok`, `paid with card=[REDACTED] ok`},
+    {`ssn-123 and ssn-456`, `[REDACTED] and [REDACTED]`},
+    {`nothing to see`, `nothing to see`},
+  }
+  for _, tt := range tests {
+    if got := r.redact(tt.in, patterns...); got != tt.want {
+      t.Errorf("redact(%q): wanted %q, got %q", tt.in, tt.want, got)
+    }
+  }
+}
+
+func TestRedactingFormatter(t *testing.T) {
+  redactions.addSecret("s3cr3t-value")
+  var buf bytes.Buffer
+  logger := log.New()
+  logger.Out = &buf
+  logger.Formatter = redactingFormatter{&log.TextFormatter{DisableColors: true}}
+  logger.WithFields(log.Fields{
+    "token": "s3cr3t-value",
+    "error": errors.New("bad token s3cr3t-value"),
+    "count": 3,
+  }).Error(`Writing STDIN: {"Authorization":"Bearer abcdef"}`)
+
+  out := buf.String()
+  if strings.Contains(out, "s3cr3t-value") || strings.Contains(out, "abcdef") {
+    t.Errorf("secret was logged: %s", out)
+  }
+  if !strings.Contains(out, "count=3") {
+    t.Errorf("other fields were lost: %s", out)
+  }
+}
+
+func TestRunBookRedact(t *testing.T) {
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  os.Setenv("CAPTAINHOOK_TEST_REDACT_TOKEN", "env-token-value")
+  defer os.Unsetenv("CAPTAINHOOK_TEST_REDACT_TOKEN")
+  ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"redact": ["card=(\\d+)"], "auth": {"fromEnv": "CAPTAINHOOK_TEST_REDACT_TOKEN"}, "scripts": []}`), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"scripts": []}`), 0644)
+
+  a, err := getRunBookById("a")
+  if err != nil {
+    t.Fatal(err)
+  }
+  b, err := getRunBookById("b")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := a.redact("card=4111"); got != "card=[REDACTED]" {
+    t.Errorf("hook a: got %q", got)
+  }
+  if got := b.redact("card=4111"); got != "card=4111" {
+    t.Errorf("pattern of hook a applied to hook b: %q", got)
+  }
+  if got := redactions.redactHook("b", "card=4111"); got != "card=4111" {
+    t.Errorf("pattern of hook a applied to the logs of hook b: %q", got)
+  }
+  // Before any request has been checked against it.
+  if got := redactions.redact("token env-token-value"); got != "token [REDACTED]" {
+    t.Errorf("credential was not registered when loaded: %q", got)
+  }
+
+  ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"scripts": []}`), 0644)
+  if a, err = getRunBookById("a"); err != nil {
+    t.Fatal(err)
+  }
+  if got := a.redact("card=4111"); got != "card=4111" {
+    t.Errorf("removed pattern still applied: %q", got)
+  }
+  if got := redactions.redactHook("a", "card=4111"); got != "card=4111" {
+    t.Errorf("removed pattern still applied to logs: %q", got)
+  }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// responseConfig shapes what a hook replies with, for callers such as Slack
+// that expect a particular answer. Headers and Body are templates rendered
+// with the request, and the script results of a synchronous run or the job
+// id of an asynchronous one.
+type responseConfig struct {
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+func (c *responseConfig) validate() error {
+	if c.Status != 0 && (c.Status < 100 || c.Status > 599) {
+		return fmt.Errorf("response status %d is not an HTTP status", c.Status)
+	}
+	for k, v := range c.Headers {
+		if _, err := parseTemplate("response header "+k, v, templateData{}); err != nil {
+			return fmt.Errorf("response header %s: %v", k, err)
+		}
+	}
+	if _, err := parseTemplate("response body", c.Body, templateData{}); err != nil {
+		return fmt.Errorf("response body: %v", err)
+	}
+	return nil
+}
+
+// write renders the response and writes it to w. status is used unless the
+// runbook sets its own. The rendered body is redacted with redact, like the
+// runbook's script output.
+func (c *responseConfig) write(w http.ResponseWriter, data templateData, status int, redact func(string) string) error {
+	headers := make(map[string]string, len(c.Headers))
+	keys := make([]string, 0, len(c.Headers))
+	for k := range c.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := render("response header "+k, c.Headers[k], data)
+		if err != nil {
+			return fmt.Errorf("response header %s: %v", k, err)
+		}
+		headers[http.CanonicalHeaderKey(k)] = redact(v)
+	}
+	body, err := render("response body", c.Body, data)
+	if err != nil {
+		return fmt.Errorf("response body: %v", err)
+	}
+	body = redact(body)
+
+	if c.Status != 0 {
+		status = c.Status
+	}
+	if _, ok := headers["Content-Type"]; !ok && json.Valid([]byte(body)) {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+
+  "github.com/gorilla/mux"
+)
+
+var slackScript = `
+{
+  "scripts": [{"command": "printf", "args": ["deployed \"%s\"", "{{.Query.service}}"]}],
+  "response": {
+    "headers": {"x-hook": "{{.Hook}}"},
+    "body": "{\"response_type\": \"in_channel\", \"text\": {{json (index .Results 0).Stdout}}}"
+  }
+}`
+
+var asyncResponseScript = `
+{
+  "async": true,
+  "scripts": [{"command": "true"}],
+  "response": {
+    "status": 200,
+    "headers": {"Content-Type": "text/plain"},
+    "body": "queued {{.Job}}"
+  }
+}`
+
+var brokenResponseScript = `
+{
+  "scripts": [{"command": "true"}],
+  "response": {"body": "{{index .Results 3}}"}
+}`
+
+func TestHookResponse(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  queue, _ = newJobQueue("", 1)
+  defer queue.stop()
+  ioutil.WriteFile(filepath.Join(dir, "slack.json"), []byte(slackScript), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "async.json"), []byte(asyncResponseScript), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte(brokenResponseScript), 0644)
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  tests := []struct {
+    hook        string
+    status      int
+    contentType string
+    header      string
+    body        string
+  }{
+    {"slack?service=api", 200, "application/json", "slack", `{"response_type": "in_channel", "text": "deployed \"api\""}`},
+    {"async", 200, "text/plain", "", "queued "},
+    {"broken", 500, "text/plain; charset=utf-8", "", "response body: "},
+  }
+  for _, tt := range tests {
+    resp, err := http.Post(ts.URL+"/"+tt.hook, "application/json", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    data, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != tt.status {
+      t.Errorf("%s: wanted %d, got %d: %s", tt.hook, tt.status, resp.StatusCode, data)
+    }
+    if ct := resp.Header.Get("Content-Type"); ct != tt.contentType {
+      t.Errorf("%s: wanted Content-Type %q, got %q", tt.hook, tt.contentType, ct)
+    }
+    if h := resp.Header.Get("X-Hook"); h != tt.header {
+      t.Errorf("%s: wanted X-Hook %q, got %q", tt.hook, tt.header, h)
+    }
+    if !strings.HasPrefix(string(data), tt.body) {
+      t.Errorf("%s: wanted body %q, got %q", tt.hook, tt.body, data)
+    }
+  }
+}
+
+func TestResponseValidate(t *testing.T) {
+  tests := []struct {
+    response responseConfig
+    err      string
+  }{
+    {responseConfig{Status: 201, Body: "{{.Job}}"}, ""},
+    {responseConfig{Status: 42}, "not an HTTP status"},
+    {responseConfig{Body: "{{.Job"}, "response body"},
+    {responseConfig{Headers: map[string]string{"X-Job": "{{end}}"}}, "response header X-Job"},
+  }
+  for _, tt := range tests {
+    err := tt.response.validate()
+    if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+      t.Errorf("%+v: wanted error %q, got %v", tt.response, tt.err, err)
+    }
+  }
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultMethods are the methods a runbook accepts unless it lists its own.
+var defaultMethods = []string{"POST"}
+
+var knownMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+// allowedMethods returns the HTTP methods the runbook can be called with.
+func (r *runBook) allowedMethods() []string {
+	if len(r.Methods) == 0 {
+		return defaultMethods
+	}
+	methods := make([]string, len(r.Methods))
+	for i, m := range r.Methods {
+		methods[i] = strings.ToUpper(m)
+	}
+	return methods
+}
+
+// MethodIsAllowed reports whether the runbook can be called with method.
+func (r *runBook) MethodIsAllowed(method string) bool {
+	for _, m := range r.allowedMethods() {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRoute checks the methods and path of a runbook.
+func (r *runBook) validateRoute() error {
+	for _, m := range r.Methods {
+		if !knownMethods[strings.ToUpper(m)] {
+			return fmt.Errorf("unknown method '%s'", m)
+		}
+	}
+	if r.Path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path '%s' must start with /", r.Path)
+	}
+	// A leading parameter would shadow every other hook.
+	first := strings.SplitN(r.Path[1:], "/", 2)[0]
+	if first == "" || strings.Contains(first, "{") {
+		return fmt.Errorf("path '%s' must start with a fixed segment", r.Path)
+	}
+	if reservedHookNamespaces[first] {
+		return fmt.Errorf("path '%s' is reserved", r.Path)
+	}
+	if r.shadows(first) {
+		return fmt.Errorf("path '%s' would take over the hooks at /%s", r.Path, first)
+	}
+	if err := mux.NewRouter().Path(r.Path).GetError(); err != nil {
+		return fmt.Errorf("path '%s': %v", r.Path, err)
+	}
+	return nil
+}
+
+// shadows reports whether a path starting with the segment first would take
+// over other hooks: the hook whose id is first, or those in its directory
+// unless the runbook is in that directory itself.
+func (r *runBook) shadows(first string) bool {
+	if first == r.ID || !hookIDRegexp.MatchString(first) {
+		return false
+	}
+	if path, err := findSettings(first); err != nil || path != "" {
+		return true
+	}
+	if strings.HasPrefix(r.ID, first+"/") {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(configdir, first))
+	return err == nil && info.IsDir()
+}
+
+// routeTable routes requests to captainhook's endpoints and to the hooks.
+// Hooks are served at /<id> unless their runbook declares a path; those
+// routes are generated from the runbooks in the configdir and rebuilt when
+// they change.
+type routeTable struct {
+	mu     sync.RWMutex
+	router *mux.Router
+	paths  map[string]string
+}
+
+var routes = &routeTable{router: newRouter(nil)}
+
+// newRouter returns a router serving the probes, the job api, the hooks in
+// paths, by path pattern, at their paths and every other hook at its id.
+func newRouter(paths map[string]string) *mux.Router {
+	r := mux.NewRouter()
+	probes := map[string]http.HandlerFunc{
+		healthPath:  healthHandler,
+		readyPath:   readyHandler,
+		versionPath: versionHandler,
+	}
+	for p, h := range probes {
+		if p != "" {
+			r.HandleFunc(p, h).Methods("GET", "HEAD")
+		}
+	}
+	r.HandleFunc("/jobs/{id}", jobHandler).Methods("GET")
+	r.HandleFunc("/jobs/{id}/replay", replayHandler).Methods("POST")
+	patterns := make([]string, 0, len(paths))
+	for p := range paths {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		r.HandleFunc(p, pathHandler(paths[p], p))
+	}
+	r.HandleFunc("/{id:"+hookIDPattern+"}", hookHandler)
+	return r
+}
+
+func (t *routeTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.RLock()
+	router := t.router
+	t.mu.RUnlock()
+	router.ServeHTTP(w, r)
+}
+
+// reload regenerates the routes from the runbooks in the configdir. If two
+// runbooks declare the same path the first, by id, gets it.
+func (t *routeTable) reload() {
+	ids, err := listRunBooks()
+	if err != nil {
+		log.WithField("error", err).Error("Failed to list runbooks!")
+		return
+	}
+	paths := make(map[string]string)
+	for _, id := range ids {
+		rb, err := getRunBookById(id)
+		if err != nil || rb.Path == "" {
+			continue
+		}
+		if other, ok := paths[rb.Path]; ok {
+			log.WithFields(log.Fields{
+				"hook":  id,
+				"path":  rb.Path,
+				"other": other,
+			}).Error("Path is taken by another hook!")
+			continue
+		}
+		paths[rb.Path] = id
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paths != nil && samePaths(paths, t.paths) {
+		return
+	}
+	t.router = newRouter(paths)
+	t.paths = paths
+	log.WithField("paths", len(paths)).Info("Rebuilt hook routes.")
+}
+
+func samePaths(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p, id := range a {
+		if b[p] != id {
+			return false
+		}
+	}
+	return true
+}
+
+// watch reloads the routes every scanInterval, so that paths are picked up
+// as schedules are. Until then calls to a new path fail and a changed one is
+// still routed at the old path, which refuses the call.
+func (t *routeTable) watch() {
+	for range time.Tick(scanInterval) {
+		t.reload()
+	}
+}
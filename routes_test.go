@@ -0,0 +1,147 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+var routedScript = `
+{
+  "methods": ["post", "PUT"],
+  "path": "/deploy/{env}/{service}",
+  "scripts": [
+    {
+      "command": "sh",
+      "args": ["-c", "echo {{.Params.env}} $CAPTAINHOOK_PARAM_SERVICE {{.Query.tag}} $CAPTAINHOOK_QUERY_TAG"]
+    }
+  ]
+}`
+
+var getScript = `
+{
+  "methods": ["GET"],
+  "scripts": [{"command": "echo", "args": ["pong"]}]
+}`
+
+func TestRoutes(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  queue, _ = newJobQueue("", 0)
+  echo = true
+  defer func() { echo = false }()
+  ioutil.WriteFile(filepath.Join(dir, "deploy.json"), []byte(routedScript), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "ping.json"), []byte(getScript), 0644)
+
+  table := &routeTable{router: newRouter(nil)}
+  table.reload()
+  ts := httptest.NewServer(table)
+  defer ts.Close()
+
+  tests := []struct {
+    method string
+    path   string
+    status int
+    stdout string
+    allow  string
+  }{
+    {"POST", "/deploy/prod/api?tag=v1", 200, "prod api v1 v1\n", ""},
+    {"PUT", "/deploy/staging/web", 200, "staging web\n", ""},
+    {"GET", "/deploy/prod/api", 405, "", "POST, PUT"},
+    {"POST", "/deploy", 404, "", ""},
+    {"POST", "/deploy/prod", 500, "", ""},
+    {"GET", "/ping", 200, "pong\n", ""},
+    {"POST", "/ping", 405, "", "GET"},
+  }
+  for _, tt := range tests {
+    req, _ := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    data, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != tt.status {
+      t.Errorf("%s %s: wanted %d, got %d: %s", tt.method, tt.path, tt.status, resp.StatusCode, data)
+      continue
+    }
+    if allow := resp.Header.Get("Allow"); allow != tt.allow {
+      t.Errorf("%s %s: wanted Allow %q, got %q", tt.method, tt.path, tt.allow, allow)
+    }
+    if tt.stdout == "" {
+      continue
+    }
+    var response runBookResponse
+    if err := json.Unmarshal(data, &response); err != nil {
+      t.Fatalf("%s %s: %v: %s", tt.method, tt.path, err, data)
+    }
+    if got := response.Results[0].Stdout; got != tt.stdout {
+      t.Errorf("%s %s: wanted %q, got %q", tt.method, tt.path, tt.stdout, got)
+    }
+  }
+
+  // A path may not take over another hook.
+  ioutil.WriteFile(filepath.Join(dir, "shadow.json"), []byte(`{"path": "/ping/{x}", "scripts": []}`), 0644)
+  if _, err := getRunBookById("shadow"); err == nil || !strings.Contains(err.Error(), "take over") {
+    t.Errorf("wanted an error about taking over /ping, got %v", err)
+  }
+  os.Mkdir(filepath.Join(dir, "team"), 0755)
+  ioutil.WriteFile(filepath.Join(dir, "team", "build.json"), []byte(`{"scripts": []}`), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "shadow.json"), []byte(`{"path": "/team/{x}", "scripts": []}`), 0644)
+  if _, err := getRunBookById("shadow"); err == nil || !strings.Contains(err.Error(), "take over") {
+    t.Errorf("wanted an error about taking over /team, got %v", err)
+  }
+  ioutil.WriteFile(filepath.Join(dir, "team", "deploy.json"), []byte(`{"path": "/team/deploy/{env}", "scripts": []}`), 0644)
+  if _, err := getRunBookById("team/deploy"); err != nil {
+    t.Errorf("path in the hook's own directory: %v", err)
+  }
+  table.reload()
+  if table.paths["/ping/{x}"] != "" || table.paths["/team/{x}"] != "" {
+    t.Errorf("path taking over another hook was routed: %v", table.paths)
+  }
+  os.Remove(filepath.Join(dir, "shadow.json"))
+  os.RemoveAll(filepath.Join(dir, "team"))
+
+  // A path that is already taken stays with the first hook.
+  ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte(routedScript), 0644)
+  table.reload()
+  if table.paths["/deploy/{env}/{service}"] != "deploy" {
+    t.Errorf("path went to %q", table.paths["/deploy/{env}/{service}"])
+  }
+}
+
+func TestValidateRoute(t *testing.T) {
+  tests := []struct {
+    methods []string
+    path    string
+    err     string
+  }{
+    {nil, "", ""},
+    {[]string{"get", "DELETE"}, "/svc/{name:[a-z]+}", ""},
+    {[]string{"FETCH"}, "", "unknown method"},
+    {nil, "deploy/{env}", "must start with /"},
+    {nil, "/{env}/deploy", "fixed segment"},
+    {nil, "/jobs/{id}", "reserved"},
+    {nil, "/deploy/{env", "path '/deploy/{env'"},
+  }
+  for _, tt := range tests {
+    r := &runBook{Methods: tt.methods, Path: tt.path}
+    err := r.validateRoute()
+    if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+      t.Errorf("%v %q: wanted error %q, got %v", tt.methods, tt.path, tt.err, err)
+    }
+  }
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,18 +23,64 @@ import (
 
 // runBook represents a collection of scripts.
 type runBook struct {
-	ID              string        `json:"-"`
-	ExecTime        time.Duration `json:"-"`
-	Scripts         []script      `json:"scripts"`
-	AllowedNetworks Networks      `json:"allowedNetworks,omitempty"`
-	AuthToken       string        `json:"auth,omitempty"`
-	Async           bool          `json:"async,omitempty"`
+	ID                  string            `json:"-"`
+	ExecTime            time.Duration     `json:"-"`
+	Scripts             []script          `json:"scripts"`
+	AllowedNetworks     Networks          `json:"allowedNetworks,omitempty"`
+	AllowedCerts        []clientCertRule  `json:"allowedClientCerts,omitempty"`
+	Auth                credentials       `json:"auth,omitempty"`
+	JWT                 *jwtConfig        `json:"jwt,omitempty"`
+	Signature           *signatureConfig  `json:"signature,omitempty"`
+	Nonce               *nonceConfig      `json:"nonce,omitempty"`
+	RateLimit           *rateLimit        `json:"rateLimit,omitempty"`
+	MaxBodyBytes        int64             `json:"maxBodyBytes,omitempty"`
+	AllowedContentTypes []string          `json:"allowedContentTypes,omitempty"`
+	Redact              []string          `json:"redact,omitempty"`
+	Timeout             duration          `json:"timeout,omitempty"`
+	Extends             string            `json:"extends,omitempty"`
+	Include             []string          `json:"include,omitempty"`
+	Vars                map[string]string `json:"vars,omitempty"`
+	StrictEnv           bool              `json:"strictEnv,omitempty"`
+	AllowUnknownFields  bool              `json:"allowUnknownFields,omitempty"`
+	Env                 map[string]string `json:"env,omitempty"`
+	Async               bool              `json:"async,omitempty"`
+	OnRestart           string            `json:"onRestart,omitempty"`
+	Concurrency         int               `json:"concurrency,omitempty"`
+	Schedule            string            `json:"schedule,omitempty"`
+	Methods             []string          `json:"methods,omitempty"`
+	Path                string            `json:"path,omitempty"`
+	Response            *responseConfig   `json:"response,omitempty"`
+
+	redactPatterns []*regexp.Regexp
 }
 
 type runBookResponse struct {
 	Results []result `json:"results"`
 }
 
+// ok reports whether every script exited cleanly.
+func (r *runBookResponse) ok() bool {
+	for _, rs := range r.Results {
+		if rs.StatusCode != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// exitCode is the status of the first script that failed, or 0.
+func (r *runBookResponse) exitCode() int {
+	for _, rs := range r.Results {
+		switch {
+		case rs.StatusCode > 0:
+			return rs.StatusCode
+		case rs.StatusCode < 0:
+			return 1
+		}
+	}
+	return 0
+}
+
 type result struct {
 	Stdout     string `json:"stdout"`
 	Stderr     string `json:"stderr"`
@@ -35,8 +88,20 @@ type result struct {
 }
 
 type script struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env,omitempty"`
+	Dir     string            `json:"dir,omitempty"`
+}
+
+// resolvedScript is a script with its templates rendered, ready to be run.
+// Env only holds the variables added to captainhook's own environment.
+type resolvedScript struct {
 	Command string   `json:"command"`
 	Args    []string `json:"args"`
+	Env     []string `json:"env"`
+	Dir     string   `json:"dir"`
+	Error   string   `json:"error,omitempty"`
 }
 
 // Networks is its own struct for JSON unmarshalling gymnastics
@@ -62,6 +127,43 @@ func (nets *Networks) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON for custom type Networks
+func (nets Networks) MarshalJSON() ([]byte, error) {
+	ns := make([]string, len(nets.Networks))
+	for i, nw := range nets.Networks {
+		ns[i] = nw.String()
+	}
+	return json.Marshal(ns)
+}
+
+// duration is a time.Duration that unmarshals from strings like "5m" or a
+// number of seconds.
+type duration time.Duration
+
+// UnmarshalJSON for custom type duration
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var secs float64
+	if err := json.Unmarshal(data, &secs); err == nil {
+		*d = duration(secs * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// MarshalJSON for custom type duration
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
 // NewRunBook returns the runBook identified by id.
 func NewRunBook(id string) (*runBook, error) {
 	return getRunBookById(id)
@@ -79,64 +181,213 @@ func (r *runBook) AddrIsAllowed(remoteIP net.IP) bool {
 	return false
 }
 
-func (r *runBook) Authorized(req *http.Request) bool {
-	if r.AuthToken == "" {
+// ClientCertIsAllowed reports whether the verified client certificate of the
+// connection matches one of the runbook's allowedClientCerts rules.
+func (r *runBook) ClientCertIsAllowed(state *tls.ConnectionState) bool {
+	if len(r.AllowedCerts) == 0 {
 		return true
 	}
-
-	token, _, ok := req.BasicAuth()
-	if !ok || token != r.AuthToken {
+	if state == nil || len(state.VerifiedChains) == 0 {
 		return false
 	}
-	return true
+	leaf := state.VerifiedChains[0][0]
+	for _, rule := range r.AllowedCerts {
+		if rule.matches(leaf) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runBook) Authorized(req *http.Request) bool {
+	_, ok := r.authenticate(req)
+	return ok
+}
+
+// authenticate checks req against the runbook's credentials and returns the
+// name of the one that matched.
+func (r *runBook) authenticate(req *http.Request) (string, bool) {
+	if len(r.Auth) == 0 {
+		return "", true
+	}
+
+	name, ok := r.Auth.authenticate(req)
+	if ok {
+		log.WithFields(log.Fields{
+			"hook":       r.ID,
+			"credential": name,
+		}).Debug("Authenticated.")
+	}
+	return name, ok
+}
+
+// verifyJWT checks the bearer token of req if the runbook requires one, and
+// returns the claims to hand to scripts and the token's subject.
+func (r *runBook) verifyJWT(req *http.Request) (map[string]string, string, error) {
+	if r.JWT == nil {
+		return nil, "", nil
+	}
+	claims, err := r.JWT.verify(req, time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+	subject, _ := claims["sub"].(string)
+	log.WithFields(log.Fields{
+		"hook":    r.ID,
+		"subject": subject,
+	}).Debug("Verified JWT.")
+	return r.JWT.exposed(claims), subject, nil
 }
 
 func (r *runBook) trackTime(start time.Time) {
 	r.ExecTime = time.Since(start)
 }
 
+// resolve renders the templates in s for in and works out the command,
+// environment and working directory it would run with.
+func (r *runBook) resolve(s script, in input) (resolvedScript, error) {
+	data := newTemplateData(r.ID, in)
+	rs := resolvedScript{Args: make([]string, len(s.Args))}
+	var err error
+	for i, arg := range s.Args {
+		if rs.Args[i], err = render(fmt.Sprintf("%s arg %d", s.Command, i), arg, data); err != nil {
+			return rs, err
+		}
+	}
+
+	env := map[string]string{"CAPTAINHOOK_HOOK": r.ID}
+	for k, v := range r.Env {
+		env[k] = v
+	}
+	for k, v := range s.Env {
+		env[k] = v
+	}
+	for k, v := range in.Claims {
+		env[envName("CAPTAINHOOK_CLAIM_", k)] = v
+	}
+	for k, v := range in.Params {
+		env[envName("CAPTAINHOOK_PARAM_", k)] = v
+	}
+	for k, v := range in.Query {
+		env[envName("CAPTAINHOOK_QUERY_", k)] = v
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := render(fmt.Sprintf("%s env %s", s.Command, k), env[k], data)
+		if err != nil {
+			return rs, err
+		}
+		rs.Env = append(rs.Env, k+"="+v)
+	}
+
+	if rs.Dir, err = render(s.Command+" dir", s.Dir, data); err != nil {
+		return rs, err
+	}
+	if rs.Dir == "" {
+		if rs.Dir, err = os.Getwd(); err != nil {
+			return rs, err
+		}
+	}
+
+	rs.Command = s.Command
+	switch {
+	case !strings.Contains(s.Command, "/"):
+		path, err := exec.LookPath(s.Command)
+		if err != nil {
+			rs.Error = err.Error()
+		} else {
+			rs.Command = path
+		}
+	case !filepath.IsAbs(s.Command):
+		rs.Command = filepath.Join(rs.Dir, s.Command)
+	}
+	return rs, nil
+}
+
+// plan resolves every script in the runbook without running any of them.
+func (r *runBook) plan(in input) ([]resolvedScript, error) {
+	plan := make([]resolvedScript, 0, len(r.Scripts))
+	for _, x := range r.Scripts {
+		rs, err := r.resolve(x, in)
+		if err != nil {
+			return nil, fmt.Errorf("script '%s': %v", x.Command, err)
+		}
+		plan = append(plan, rs)
+	}
+	return plan, nil
+}
+
 func (r *runBook) execute(in input) (*runBookResponse, error) {
 	defer r.trackTime(time.Now())
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.Timeout))
+		defer cancel()
+	}
 	results := make([]result, 0)
 	for _, x := range r.Scripts {
 		log.WithFields(log.Fields{
 			"hook":   r.ID,
 			"script": x.Command,
 		}).Debug("Executing script.")
-		rs, err := execScript(x, in)
+		rs, err := r.resolve(x, in)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"hook":   r.ID,
+				"script": x.Command,
+				"error":  err,
+			}).Error("Could not render script!")
+			results = append(results, result{Stderr: err.Error(), StatusCode: -1})
+			continue
+		}
+		res, err := execScript(ctx, rs, in)
+		if ctx.Err() == context.DeadlineExceeded {
+			res.StatusCode = -1
+			res.Stderr += fmt.Sprintf("captainhook: runbook timed out after %v\n", time.Duration(r.Timeout))
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
 				"hook":   r.ID,
 				"script": x.Command,
 				"error":  err,
-			}).Errorf("Script failed! STDERR: %s", rs.Stderr)
+			}).Errorf("Script failed! STDERR: %s", res.Stderr)
 		}
 		log.WithFields(log.Fields{
 			"hook":   r.ID,
 			"script": x.Command,
-		}).Debugf("Script results: %+v", rs)
-		results = append(results, rs)
+		}).Debugf("Script results: %+v", res)
+		results = append(results, res)
 	}
 	return &runBookResponse{results}, nil
 }
 
-func execScript(s script, in input) (r result, err error) {
-	cmd := exec.Command(s.Command, s.Args...)
-	log.WithField("script", s.Command).Debugf("Script: %+v", s)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"script": s.Command,
-			"error":  err,
-		}).Error("Unable to create STDIN pipe!")
+// scriptWaitDelay is how long a script's output is still read after it has
+// been killed, in case something it started holds on to it.
+const scriptWaitDelay = time.Second
+
+// execScript runs s with in on its STDIN. The script is killed when ctx is
+// done, along with whatever it started.
+func execScript(ctx context.Context, s resolvedScript, in input) (r result, err error) {
+	cmd := exec.CommandContext(ctx, s.Command, s.Args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
+	cmd.WaitDelay = scriptWaitDelay
+	cmd.Env = append(os.Environ(), s.Env...)
+	cmd.Dir = s.Dir
+	log.WithField("script", s.Command).Debugf("Script: %+v", s)
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	log.WithField("script", s.Command).Debugf("Writing STDIN: %s", in.Stdin)
-	stdin.Write(in.Stdin)
-	stdin.Close()
+	cmd.Stdin = bytes.NewReader(in.Stdin)
 	err = cmd.Run()
 	r.Stdout = stdout.String()
 	r.Stderr = stderr.String()
@@ -148,21 +399,114 @@ func execScript(s script, in input) (r result, err error) {
 	return
 }
 
-func getRunBookById(id string) (*runBook, error) {
-	var r = new(runBook)
-	r.ID = id
-	runBookPath := fmt.Sprintf("%s/%s.json", configdir, id)
-	data, err := ioutil.ReadFile(runBookPath)
+// runBookSettings returns the effective settings of runbook id: its file
+// with templates, defaults and references resolved.
+func runBookSettings(id string) (map[string]interface{}, error) {
+	path, err := runBookPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"hook":  id,
 			"error": err,
 		}).Error("Failed to read runbook!")
-		return r, fmt.Errorf("failed to read runbook '%s.json'", id)
+		return nil, fmt.Errorf("failed to read runbook '%s'", id)
+	}
+	settings, err := expandSettings(path, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if settings, err = withDefaults(id, settings); err != nil {
+		return nil, err
+	}
+	if err := interpolate(settings); err != nil {
+		return nil, err
+	}
+	if err := checkFields(id, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func getRunBookById(id string) (*runBook, error) {
+	var r = new(runBook)
+	r.ID = id
+	settings, err := runBookSettings(id)
+	if err != nil {
+		return r, err
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return r, err
 	}
 	err = json.Unmarshal(data, r)
 	if err != nil {
 		return r, err
 	}
-	return r, nil
+	return r, r.validate()
+}
+
+// validate checks the parts of a runbook that cannot be checked while
+// unmarshalling.
+func (r *runBook) validate() error {
+	if r.JWT != nil {
+		if err := r.JWT.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Signature != nil {
+		if err := r.Signature.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Nonce != nil && r.Nonce.Header == "" {
+		return fmt.Errorf("nonce needs a header")
+	}
+	if r.RateLimit != nil {
+		if err := r.RateLimit.parse(); err != nil {
+			return err
+		}
+	}
+	if err := r.validateRoute(); err != nil {
+		return err
+	}
+	if r.Response != nil {
+		if err := r.Response.validate(); err != nil {
+			return err
+		}
+	}
+	r.Auth.registerSecrets()
+	if r.Signature != nil {
+		r.Signature.Secret.registerSecrets()
+	}
+	return r.compileRedact()
+}
+
+// listRunBooks returns the ids of all runbooks in the configdir, including
+// those in subdirectories.
+func listRunBooks() ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	err := filepath.Walk(configdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isRunBookFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(configdir, path)
+		if err != nil {
+			return err
+		}
+		id := filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel)))
+		// A runbook in several formats is listed once and fails to load.
+		if validateHookID(id) == nil && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return ids, err
 }
@@ -109,3 +109,24 @@ func TestInput(t *testing.T) {
     }
   }
 }
+
+func TestExitCode(t *testing.T) {
+  tests := []struct {
+    codes []int
+    want  int
+  }{
+    {[]int{}, 0},
+    {[]int{0, 0}, 0},
+    {[]int{0, 3, 2}, 3},
+    {[]int{-1, 3}, 1},
+  }
+  for _, tt := range tests {
+    resp := runBookResponse{}
+    for _, c := range tt.codes {
+      resp.Results = append(resp.Results, result{StatusCode: c})
+    }
+    if got := resp.exitCode(); got != tt.want {
+      t.Errorf("exitCode(%v): wanted %d, got %d", tt.codes, tt.want, got)
+    }
+  }
+}
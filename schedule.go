@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// scanInterval is how often the scheduler looks for new or changed
+// schedules in the configdir.
+const scanInterval = time.Minute
+
+// schedule computes when a scheduled runbook should run next.
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+// everySchedule runs at a fixed interval, as in "@every 10m".
+type everySchedule struct {
+	every time.Duration
+}
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Truncate(time.Second).Add(s.every)
+}
+
+// cronSchedule is a standard 5-field cron expression. Each field is a bit set
+// of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	dowNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+const starBit = 1 << 63
+
+// parseSchedule parses a 5-field cron expression, one of the @yearly style
+// macros or "@every <duration>".
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("invalid schedule '%s': interval must be at least 1s", spec)
+		}
+		return everySchedule{d}, nil
+	}
+	if m, ok := cronMacros[spec]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule '%s': expected 5 fields, got %d", spec, len(fields))
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': minute: %v", spec, err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': hour: %v", spec, err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': day of month: %v", spec, err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': month: %v", spec, err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, dowNames); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': day of week: %v", spec, err)
+	}
+	// Both 0 and 7 are Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	// As in Vixie cron, a field starting with * counts as unrestricted when
+	// days of the month and week are combined, even with a step.
+	if strings.HasPrefix(field, "*") {
+		bits |= starBit
+	}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in '%s'", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], min, max, names); err != nil {
+				return 0, err
+			}
+			if hi, err = parseCronValue(bounds[1], min, max, names); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("bad range '%s'", part)
+			}
+		default:
+			v, err := parseCronValue(part, min, max, names)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, min, max int, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value '%s'", s)
+	}
+	if v < min || v > max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, min, max)
+	}
+	return v, nil
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	// As in cron, if both fields are restricted either may match.
+	if s.dom&starBit != 0 || s.dow&starBit != 0 {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			// By the wall clock: zones can be offset by a fraction of an hour.
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// scheduleEntry tracks a single scheduled runbook.
+type scheduleEntry struct {
+	Hook      string    `json:"hook"`
+	Schedule  string    `json:"schedule"`
+	Next      time.Time `json:"next"`
+	Last      time.Time `json:"last"`
+	LastJob   string    `json:"lastJob,omitempty"`
+	LastState jobState  `json:"lastState,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	sched schedule
+}
+
+// scheduler runs runbooks that declare a schedule.
+type scheduler struct {
+	mu      sync.Mutex
+	entries map[string]*scheduleEntry
+	q       *jobQueue
+	stopped bool
+	stopc   chan struct{}
+	firing  sync.WaitGroup
+}
+
+func newScheduler(q *jobQueue) *scheduler {
+	return &scheduler{
+		entries: make(map[string]*scheduleEntry),
+		q:       q,
+		stopc:   make(chan struct{}),
+	}
+}
+
+// scan picks up added, changed and removed schedules from the configdir.
+func (s *scheduler) scan(now time.Time) {
+	ids, err := listRunBooks()
+	if err != nil {
+		log.WithField("error", err).Error("Failed to list runbooks!")
+		return
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		rb, err := getRunBookById(id)
+		if err != nil || rb.Schedule == "" {
+			continue
+		}
+		seen[id] = true
+		s.mu.Lock()
+		e, ok := s.entries[id]
+		if ok && e.Schedule == rb.Schedule {
+			s.mu.Unlock()
+			continue
+		}
+		if !ok {
+			e = &scheduleEntry{Hook: id}
+			s.entries[id] = e
+		}
+		e.Schedule = rb.Schedule
+		e.Error = ""
+		e.Next = time.Time{}
+		if e.sched, err = parseSchedule(rb.Schedule); err != nil {
+			e.Error = err.Error()
+			log.WithFields(log.Fields{
+				"hook":  id,
+				"error": err,
+			}).Error("Invalid schedule!")
+		} else {
+			e.Next = e.sched.next(now)
+		}
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	for id := range s.entries {
+		if !seen[id] {
+			delete(s.entries, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// due returns copies of the entries that should run at now and advances
+// them.
+func (s *scheduler) due(now time.Time) []scheduleEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []scheduleEntry
+	for _, e := range s.entries {
+		if e.sched == nil || e.Next.IsZero() || e.Next.After(now) {
+			continue
+		}
+		due = append(due, *e)
+		e.Next = e.sched.next(now)
+	}
+	return due
+}
+
+// record updates the entry for hook, if it is still scheduled.
+func (s *scheduler) record(hook string, fn func(*scheduleEntry)) {
+	s.mu.Lock()
+	if e, ok := s.entries[hook]; ok {
+		fn(e)
+	}
+	s.mu.Unlock()
+}
+
+// wake returns when the scheduler next needs to do something.
+func (s *scheduler) wake(now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wake := now.Add(scanInterval)
+	for _, e := range s.entries {
+		if !e.Next.IsZero() && e.Next.Before(wake) {
+			wake = e.Next
+		}
+	}
+	return wake
+}
+
+// fire runs the runbook for e with a synthetic input, unless the hook is
+// disabled or the runbook's concurrency limit has been reached.
+func (s *scheduler) fire(e scheduleEntry) {
+	if disabled.has(e.Hook) {
+		log.WithField("hook", e.Hook).Info("Hook is disabled, skipping scheduled run.")
+		return
+	}
+	rb, err := NewRunBook(e.Hook)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":  e.Hook,
+			"error": err,
+		}).Error("RunBook Error!")
+		return
+	}
+	if !slots.acquire(rb.ID, rb.Concurrency, false) {
+		log.WithFields(log.Fields{
+			"hook":        rb.ID,
+			"concurrency": rb.Concurrency,
+		}).Warn("Hook is at its concurrency limit, skipping scheduled run.")
+		return
+	}
+	defer slots.release(rb.ID)
+
+	in, err := scheduleInput(e.Schedule)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":  rb.ID,
+			"error": err,
+		}).Error("Could not build scheduled input!")
+		return
+	}
+	j, err := s.q.create(rb, in, "", false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"hook":  rb.ID,
+			"error": err,
+		}).Error("Could not record job!")
+		return
+	}
+	s.record(e.Hook, func(e *scheduleEntry) {
+		e.Last = j.Created
+		e.LastJob = j.ID
+		e.LastState = j.State
+	})
+
+	log.WithFields(log.Fields{
+		"hook":     rb.ID,
+		"job":      j.ID,
+		"schedule": e.Schedule,
+	}).Info("Running scheduled hook.")
+	s.q.process(j)
+
+	s.record(e.Hook, func(e *scheduleEntry) {
+		if e.LastJob == j.ID {
+			e.LastState = j.State
+		}
+	})
+}
+
+// scheduleInput is what a scheduled run hands to its scripts in place of a
+// request.
+func scheduleInput(spec string) (input, error) {
+	headers := map[string]string{"X-Captainhook-Schedule": spec}
+	h, err := json.Marshal(headers)
+	if err != nil {
+		return input{}, err
+	}
+	return input{
+		Headers: headers,
+		Stdin:   append(h, '\n'),
+	}, nil
+}
+
+// list returns the scheduled runbooks sorted by hook id.
+func (s *scheduler) list() []scheduleEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]scheduleEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, *e)
+	}
+	sort.Sort(byHook(list))
+	return list
+}
+
+type byHook []scheduleEntry
+
+func (l byHook) Len() int           { return len(l) }
+func (l byHook) Less(i, j int) bool { return l[i].Hook < l[j].Hook }
+func (l byHook) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// run scans the configdir and fires due runbooks until the scheduler is
+// stopped.
+func (s *scheduler) run() {
+	lastScan := time.Now()
+	s.scan(lastScan)
+	for {
+		now := time.Now()
+		timer := time.NewTimer(s.wake(now).Sub(now))
+		select {
+		case <-s.stopc:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		now = time.Now()
+		if now.Sub(lastScan) >= scanInterval {
+			s.scan(now)
+			lastScan = now
+		}
+		if !s.start(s.due(now)) {
+			return
+		}
+	}
+}
+
+// start fires entries unless the scheduler has been stopped.
+func (s *scheduler) start(entries []scheduleEntry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	for _, e := range entries {
+		s.firing.Add(1)
+		go func(e scheduleEntry) {
+			defer s.firing.Done()
+			s.fire(e)
+		}(e)
+	}
+	return true
+}
+
+// stop keeps the scheduler from firing any more runs. Runs already started
+// carry on; waitIdle waits for them.
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopc)
+	}
+}
+
+// waitIdle waits until no scheduled runs are in progress, or ctx is done.
+func (s *scheduler) waitIdle(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.firing.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestParseSchedule(t *testing.T) {
+  from := time.Date(2015, time.June, 12, 10, 7, 30, 0, time.UTC) // a Friday
+
+  tests := []struct {
+    spec string
+    next time.Time
+  }{
+    {"* * * * *", time.Date(2015, time.June, 12, 10, 8, 0, 0, time.UTC)},
+    {"*/15 * * * *", time.Date(2015, time.June, 12, 10, 15, 0, 0, time.UTC)},
+    {"5 4 * * *", time.Date(2015, time.June, 13, 4, 5, 0, 0, time.UTC)},
+    {"0 9-17 * * mon-fri", time.Date(2015, time.June, 12, 11, 0, 0, 0, time.UTC)},
+    {"0 0 * * 7", time.Date(2015, time.June, 14, 0, 0, 0, 0, time.UTC)},
+    {"0 0 1,15 * *", time.Date(2015, time.June, 15, 0, 0, 0, 0, time.UTC)},
+    {"0 0 1 * 1", time.Date(2015, time.June, 15, 0, 0, 0, 0, time.UTC)},
+    {"30 2 29 feb *", time.Date(2016, time.February, 29, 2, 30, 0, 0, time.UTC)},
+    {"@daily", time.Date(2015, time.June, 13, 0, 0, 0, 0, time.UTC)},
+    {"@every 10m", time.Date(2015, time.June, 12, 10, 17, 30, 0, time.UTC)},
+  }
+  for _, tt := range tests {
+    s, err := parseSchedule(tt.spec)
+    if err != nil {
+      t.Errorf("parseSchedule(%q): %v", tt.spec, err)
+      continue
+    }
+    if next := s.next(from); !next.Equal(tt.next) {
+      t.Errorf("parseSchedule(%q).next: wanted %v, got %v", tt.spec, tt.next, next)
+    }
+  }
+
+  // A step still leaves day of month unrestricted, so both days must match.
+  s, _ := parseSchedule("0 0 */2 * mon")
+  if next, want := s.next(from), time.Date(2015, time.June, 15, 0, 0, 0, 0, time.UTC); !next.Equal(want) {
+    t.Errorf("*/2 with a day of week: wanted %v, got %v", want, next)
+  }
+
+  // Hours are stepped by the wall clock in zones with half hour offsets.
+  kolkata := time.FixedZone("IST", 5*3600+1800)
+  s, _ = parseSchedule("0 12 * * *")
+  if next, want := s.next(time.Date(2015, time.June, 12, 10, 7, 0, 0, kolkata)), time.Date(2015, time.June, 12, 12, 0, 0, 0, kolkata); !next.Equal(want) {
+    t.Errorf("in IST: wanted %v, got %v", want, next)
+  }
+
+  for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@every 1ms", "@every soon"} {
+    if _, err := parseSchedule(spec); err == nil {
+      t.Errorf("parseSchedule(%q) unexpectedly succeeded", spec)
+    }
+  }
+}
+
+func TestScheduledRunRespectsConcurrency(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  script := `{"schedule": "@every 1m", "concurrency": 1, "scripts": [{"command": "echo", "args": ["tick"]}]}`
+  if err := ioutil.WriteFile(filepath.Join(dir, "tick.json"), []byte(script), 0644); err != nil {
+    t.Fatal(err)
+  }
+  q, err := newJobQueue("", 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s := newScheduler(q)
+  now := time.Now()
+  s.scan(now)
+
+  entries := s.list()
+  if len(entries) != 1 || !entries[0].Next.Equal(now.Truncate(time.Second).Add(time.Minute)) {
+    t.Fatalf("unexpected schedule: %+v", entries)
+  }
+
+  // With the only slot taken the scheduled run is skipped.
+  slots.acquire("tick", 1, false)
+  s.fire(entries[0])
+  slots.release("tick")
+  if e := s.list()[0]; e.LastJob != "" {
+    t.Errorf("scheduled run was not skipped: %+v", e)
+  }
+
+  s.fire(entries[0])
+  e := s.list()[0]
+  if e.LastJob == "" || e.LastState != jobSucceeded {
+    t.Errorf("scheduled run did not succeed: %+v", e)
+  }
+  j, err := q.get(e.LastJob)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if out := j.Response.Results[0].Stdout; out != "tick\n" {
+    t.Errorf("wanted %q, got %q", "tick\n", out)
+  }
+}
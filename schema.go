@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// schemaOverride describes types that unmarshal from something other than
+// what reflection sees.
+func schemaOverride(t reflect.Type) (map[string]interface{}, bool) {
+	switch t {
+	case reflect.TypeOf(Networks{}):
+		return map[string]interface{}{
+			"type":  "array",
+			"items": map[string]interface{}{"type": "string", "description": "CIDR, e.g. 10.0.0.0/8"},
+		}, true
+	case reflect.TypeOf(duration(0)):
+		return map[string]interface{}{
+			"type":        []string{"string", "number"},
+			"description": "duration like 5m, or a number of seconds",
+		}, true
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}, true
+	case reflect.TypeOf(credentials{}):
+		one := []interface{}{
+			map[string]interface{}{"type": "string"},
+			schemaFor(reflect.TypeOf(credential{})),
+		}
+		return map[string]interface{}{
+			"oneOf": append(one, map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"oneOf": one},
+			}),
+		}, true
+	}
+	return nil, false
+}
+
+// jsonName returns the JSON name of a struct field, or "" if it is not
+// marshalled.
+func jsonName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+// schemaFor returns the JSON schema of values of type t.
+func schemaFor(t reflect.Type) map[string]interface{} {
+	if override, ok := schemaOverride(t); ok {
+		return override
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem())
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			if name := jsonName(t.Field(i)); name != "" {
+				props[name] = schemaFor(t.Field(i).Type)
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+var (
+	schemaOnce sync.Once
+	schema     map[string]interface{}
+)
+
+// runBookSchema returns the JSON schema of runbook files, generated from
+// the runBook type.
+func runBookSchema() map[string]interface{} {
+	schemaOnce.Do(func() {
+		schema = schemaFor(reflect.TypeOf(runBook{}))
+		schema["$schema"] = schemaDraft
+		schema["title"] = "captainhook runbook"
+		// Lets editors find the schema.
+		schema["properties"].(map[string]interface{})["$schema"] = map[string]interface{}{"type": "string"}
+	})
+	return schema
+}
+
+// jsonType returns the JSON schema type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return "number"
+}
+
+// variant picks the alternative of a oneOf schema that v could be.
+func variant(s map[string]interface{}, v interface{}) map[string]interface{} {
+	alternatives, ok := s["oneOf"].([]interface{})
+	if !ok {
+		return s
+	}
+	for _, a := range alternatives {
+		alt := a.(map[string]interface{})
+		if alt["type"] == jsonType(v) {
+			return alt
+		}
+	}
+	return s
+}
+
+// unknownFields returns the paths of the keys in v that s does not allow.
+func unknownFields(s map[string]interface{}, v interface{}, path string) []string {
+	s = variant(s, v)
+	var unknown []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := path + "." + k
+			if path == "" {
+				child = k
+			}
+			if p, ok := props[k].(map[string]interface{}); ok {
+				unknown = append(unknown, unknownFields(p, v[k], child)...)
+			} else if extra, ok := s["additionalProperties"].(map[string]interface{}); ok {
+				unknown = append(unknown, unknownFields(extra, v[k], child)...)
+			} else if s["additionalProperties"] == false {
+				if guess := closestName(k, props); guess != "" {
+					child += " (did you mean '" + guess + "'?)"
+				}
+				unknown = append(unknown, child)
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, x := range v {
+				unknown = append(unknown, unknownFields(items, x, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return unknown
+}
+
+// closestName returns the property most like name, if one is close enough
+// to be a typo: no more than three edits, and fewer for short names.
+func closestName(name string, props map[string]interface{}) string {
+	best, bestDist := "", minInt(4, len(name)/3+1)
+	for p := range props {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(p)); d < bestDist || d == bestDist && p < best {
+			best, bestDist = p, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// minInt returns the smallest of its arguments.
+func minInt(n int, rest ...int) int {
+	for _, m := range rest {
+		if m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+// checkFields fails on settings the runbook schema does not know, unless
+// they set allowUnknownFields, in which case the fields are only logged.
+func checkFields(id string, settings map[string]interface{}) error {
+	unknown := unknownFields(runBookSchema(), settings, "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	if allow, _ := settings["allowUnknownFields"].(bool); allow {
+		log.WithFields(log.Fields{
+			"hook":   id,
+			"fields": strings.Join(unknown, ", "),
+		}).Warn("Ignoring unknown runbook fields!")
+		return nil
+	}
+	return fmt.Errorf("unknown field %s", strings.Join(unknown, ", "))
+}
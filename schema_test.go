@@ -0,0 +1,66 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+func TestUnknownFields(t *testing.T) {
+  tests := []struct {
+    runbook string
+    unknown []string
+  }{
+    {`{"$schema": "x", "allowedNetworks": ["10.0.0.0/8"], "scripts": [{"command": "true", "env": {"ANY": "thing"}}]}`, nil},
+    {`{"allowNetworks": ["0.0.0.0/0"]}`, []string{"allowNetworks (did you mean 'allowedNetworks'?)"}},
+    {`{"scripts": [{"command": "a"}, {"comand": "b"}]}`, []string{"scripts[1].comand (did you mean 'command'?)"}},
+    {`{"auth": "token"}`, nil},
+    {`{"auth": [{"token": "a", "notAfter": "2015-01-01T00:00:00Z"}, {"tokn": "b"}]}`, []string{"auth[1].tokn (did you mean 'token'?)"}},
+    {`{"signature": {"scheme": "github", "secret": {"fromEnv": "X", "rotate": true}}}`, []string{"signature.secret.rotate"}},
+    {`{"jwt": {"requiredClaims": {"groups": ["deploy"]}}}`, nil},
+    {`{"zzzzzzzz": 1}`, []string{"zzzzzzzz"}},
+  }
+  for _, tt := range tests {
+    var settings map[string]interface{}
+    if err := json.Unmarshal([]byte(tt.runbook), &settings); err != nil {
+      t.Fatal(err)
+    }
+    if got := unknownFields(runBookSchema(), settings, ""); !reflect.DeepEqual(got, tt.unknown) {
+      t.Errorf("%s: wanted unknown fields %q, got %q", tt.runbook, tt.unknown, got)
+    }
+  }
+}
+
+func TestStrictRunBooks(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  ioutil.WriteFile(filepath.Join(dir, "typo.json"), []byte(`{"allowNetworks": ["10.0.0.0/8"], "scripts": []}`), 0644)
+  ioutil.WriteFile(filepath.Join(dir, "lenient.yaml"), []byte("allowUnknownFields: true\nlegacy: 1\nscripts: []\n"), 0644)
+
+  if _, err := getRunBookById("typo"); err == nil || !strings.Contains(err.Error(), "allowNetworks") {
+    t.Errorf("wanted an error about allowNetworks, got %v", err)
+  }
+  if _, err := getRunBookById("lenient"); err != nil {
+    t.Errorf("unknown fields were not allowed: %v", err)
+  }
+
+  // Every field of the runbook is in the schema.
+  data, _ := json.Marshal(runBook{JWT: &jwtConfig{}, Signature: &signatureConfig{}, Nonce: &nonceConfig{}, RateLimit: &rateLimit{}, Scripts: []script{{}}})
+  var settings map[string]interface{}
+  json.Unmarshal(data, &settings)
+  if unknown := unknownFields(runBookSchema(), settings, ""); len(unknown) != 0 {
+    t.Errorf("schema is missing %v", unknown)
+  }
+}
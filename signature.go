@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigGitHub = "github"
+	sigStripe = "stripe"
+	sigSlack  = "slack"
+
+	defaultSignatureTolerance = 5 * time.Minute
+)
+
+// signatureConfig describes how requests to a runbook are signed. Secret
+// accepts the same forms as auth, so secrets can be rotated and read from
+// the environment or files.
+type signatureConfig struct {
+	Scheme    string      `json:"scheme"`
+	Secret    credentials `json:"secret"`
+	Header    string      `json:"header,omitempty"`
+	Tolerance duration    `json:"tolerance,omitempty"`
+}
+
+func (s *signatureConfig) header() string {
+	if s.Header != "" {
+		return s.Header
+	}
+	switch s.Scheme {
+	case sigStripe:
+		return "Stripe-Signature"
+	case sigSlack:
+		return "X-Slack-Signature"
+	}
+	return "X-Hub-Signature-256"
+}
+
+func (s *signatureConfig) tolerance() time.Duration {
+	if s.Tolerance > 0 {
+		return time.Duration(s.Tolerance)
+	}
+	return defaultSignatureTolerance
+}
+
+func (s *signatureConfig) validate() error {
+	switch s.Scheme {
+	case sigGitHub, sigStripe, sigSlack:
+	default:
+		return fmt.Errorf("unknown signature scheme '%s'", s.Scheme)
+	}
+	if len(s.Secret) == 0 {
+		return fmt.Errorf("signature scheme '%s' needs a secret", s.Scheme)
+	}
+	return nil
+}
+
+func hmacHex(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, p := range parts {
+		mac.Write([]byte(p))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedPayload returns the timestamp, candidate signatures and a function
+// computing the expected signature for a secret, per scheme.
+func (s *signatureConfig) parse(req *http.Request, body []byte) (ts string, sigs []string, expected func(string) string, err error) {
+	h := req.Header.Get(s.header())
+	if h == "" {
+		return "", nil, nil, fmt.Errorf("missing %s header", s.header())
+	}
+	switch s.Scheme {
+	case sigStripe:
+		for _, part := range strings.Split(h, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "t":
+				ts = kv[1]
+			case "v1":
+				sigs = append(sigs, kv[1])
+			}
+		}
+		expected = func(secret string) string { return hmacHex(secret, ts, ".", string(body)) }
+	case sigSlack:
+		ts = req.Header.Get("X-Slack-Request-Timestamp")
+		sigs = []string{strings.TrimPrefix(h, "v0=")}
+		expected = func(secret string) string { return hmacHex(secret, "v0:", ts, ":", string(body)) }
+	default:
+		sigs = []string{strings.TrimPrefix(h, "sha256=")}
+		expected = func(secret string) string { return hmacHex(secret, string(body)) }
+		return "", sigs, expected, nil
+	}
+	if ts == "" {
+		return "", nil, nil, fmt.Errorf("missing signature timestamp")
+	}
+	return ts, sigs, expected, nil
+}
+
+// verify checks the signature of req over body. Timestamped schemes must be
+// within the tolerance of now, so that captured requests cannot be replayed
+// later.
+func (s *signatureConfig) verify(req *http.Request, body []byte, now time.Time) error {
+	ts, sigs, expected, err := s.parse(req, body)
+	if err != nil {
+		return err
+	}
+	if ts != "" {
+		secs, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad signature timestamp '%s'", ts)
+		}
+		skew := now.Sub(time.Unix(secs, 0))
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > s.tolerance() {
+			return fmt.Errorf("signature timestamp is %v away, more than %v", skew, s.tolerance())
+		}
+	}
+	for i := range s.Secret {
+		c := &s.Secret[i]
+		if !c.active(now) {
+			continue
+		}
+		secret, err := c.secret()
+		if err != nil {
+			return err
+		}
+		want := []byte(expected(secret))
+		for _, sig := range sigs {
+			if hmac.Equal([]byte(strings.ToLower(sig)), want) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("signature mismatch")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+  "bytes"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strconv"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+func TestSignatureVerify(t *testing.T) {
+  now := time.Unix(1434103200, 0)
+  ts := strconv.FormatInt(now.Unix(), 10)
+  stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+  body := []byte(`{"ref": "refs/heads/master"}`)
+  secret := credentials{{Token: "old"}, {Token: "s3cret"}}
+
+  tests := []struct {
+    scheme  string
+    headers map[string]string
+    ok      bool
+  }{
+    {sigGitHub, map[string]string{"X-Hub-Signature-256": "sha256=" + hmacHex("s3cret", string(body))}, true},
+    {sigGitHub, map[string]string{"X-Hub-Signature-256": "sha256=" + hmacHex("wrong", string(body))}, false},
+    {sigGitHub, nil, false},
+    {sigStripe, map[string]string{"Stripe-Signature": "t=" + ts + ",v1=deadbeef,v1=" + hmacHex("s3cret", ts, ".", string(body))}, true},
+    {sigStripe, map[string]string{"Stripe-Signature": "t=" + stale + ",v1=" + hmacHex("s3cret", stale, ".", string(body))}, false},
+    {sigStripe, map[string]string{"Stripe-Signature": "v1=" + hmacHex("s3cret", ts, ".", string(body))}, false},
+    {sigSlack, map[string]string{"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + hmacHex("old", "v0:", ts, ":", string(body))}, true},
+    {sigSlack, map[string]string{"X-Slack-Request-Timestamp": stale, "X-Slack-Signature": "v0=" + hmacHex("s3cret", "v0:", stale, ":", string(body))}, false},
+  }
+  for i, tt := range tests {
+    s := signatureConfig{Scheme: tt.scheme, Secret: secret}
+    req, _ := http.NewRequest("POST", "/test", nil)
+    for k, v := range tt.headers {
+      req.Header.Set(k, v)
+    }
+    err := s.verify(req, body, now)
+    if (err == nil) != tt.ok {
+      t.Errorf("test %d (%s): unexpected result %v", i, tt.scheme, err)
+    }
+  }
+}
+
+func TestNonceCache(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  queue, _ = newJobQueue("", 0)
+  nonces, err = newNonceCache(filepath.Join(dir, "nonces.log"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  script := `{"nonce": {"header": "X-GitHub-Delivery"}, "scripts": [{"command": "echo"}]}`
+  if err := ioutil.WriteFile(filepath.Join(dir, "nonce.json"), []byte(script), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  post := func(delivery string) int {
+    req, _ := http.NewRequest("POST", ts.URL+"/nonce", bytes.NewBufferString("{}"))
+    if delivery != "" {
+      req.Header.Set("X-GitHub-Delivery", delivery)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+  }
+  tests := []struct {
+    delivery   string
+    statusCode int
+  }{
+    {"", 400},
+    {"abc", 200},
+    {"abc", 409},
+    {"def", 200},
+  }
+  for _, tt := range tests {
+    if got := post(tt.delivery); got != tt.statusCode {
+      t.Errorf("delivery %q: wanted %d, got %d", tt.delivery, tt.statusCode, got)
+    }
+  }
+
+  // The ids survive a restart, expired ones do not.
+  if err := nonces.check("other", "old", time.Nanosecond); err != nil {
+    t.Fatal(err)
+  }
+  time.Sleep(time.Millisecond)
+  nonces, err = newNonceCache(filepath.Join(dir, "nonces.log"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := post("abc"); got != 409 {
+    t.Errorf("delivery abc after restart: wanted 409, got %d", got)
+  }
+  if err := nonces.check("other", "old", time.Hour); err != nil {
+    t.Errorf("expired delivery was not forgotten: %v", err)
+  }
+  nonces = &nonceCache{entries: make(map[string]time.Time)}
+}
+
+func TestSignedJobAccess(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  adminToken = "admin"
+  defer func() { adminToken = "" }()
+  if queue, err = newJobQueue(filepath.Join(dir, "jobs"), 1); err != nil {
+    t.Fatal(err)
+  }
+  defer queue.stop()
+  script := `{"signature": {"scheme": "github", "secret": "s3cret"}, "scripts": [{"command": "echo", "args": ["signed"]}]}`
+  ioutil.WriteFile(filepath.Join(dir, "signed.json"), []byte(script), 0644)
+
+  r := mux.NewRouter()
+  r.HandleFunc("/jobs/{id}", jobHandler).Methods("GET")
+  r.HandleFunc("/jobs/{id}/replay", replayHandler).Methods("POST")
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewServer(r)
+  defer ts.Close()
+
+  body := "{}"
+  req, _ := http.NewRequest("POST", ts.URL+"/signed", bytes.NewBufferString(body))
+  req.Header.Set("X-Hub-Signature-256", "sha256="+hmacHex("s3cret", body))
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal(err)
+  }
+  resp.Body.Close()
+  files, _ := filepath.Glob(filepath.Join(dir, "jobs", "*.json"))
+  if resp.StatusCode != 200 || len(files) != 1 {
+    t.Fatalf("signed call: %d, %d jobs", resp.StatusCode, len(files))
+  }
+  id := filepath.Base(files[0])
+  id = id[:len(id)-len(".json")]
+
+  tests := []struct {
+    method, path string
+    admin        bool
+    status       int
+  }{
+    {"GET", "/jobs/" + id, false, http.StatusUnauthorized},
+    {"POST", "/jobs/" + id + "/replay", false, http.StatusUnauthorized},
+    {"GET", "/jobs/" + id, true, http.StatusOK},
+    {"POST", "/jobs/" + id + "/replay", true, http.StatusAccepted},
+  }
+  for _, tt := range tests {
+    req, _ := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+    if tt.admin {
+      req.Header.Set(adminTokenHeader, "admin")
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != tt.status {
+      t.Errorf("%s %s with admin token %v: wanted %d, got %d", tt.method, tt.path, tt.admin, tt.status, resp.StatusCode)
+    }
+  }
+}
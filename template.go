@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+)
+
+// templateData is what runbook templates are rendered with. Results and Job
+// are only set when rendering a hook's response.
+type templateData struct {
+	Hook    string
+	Headers map[string]string
+	Body    string
+	Claims  map[string]string
+	Params  map[string]string
+	Query   map[string]string
+	Results []result
+	Job     string
+}
+
+func newTemplateData(id string, in input) templateData {
+	return templateData{
+		Hook:    id,
+		Headers: in.Headers,
+		Body:    string(in.Body),
+		Claims:  in.Claims,
+		Params:  in.Params,
+		Query:   in.Query,
+	}
+}
+
+// templateFuncs are the functions available to templates. {{POST}} is kept
+// as a shorthand for the request body, {{json x}} quotes x for use in JSON.
+func templateFuncs(data templateData) template.FuncMap {
+	return template.FuncMap{
+		"POST": func() string { return data.Body },
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+}
+
+func parseTemplate(name, text string, data templateData) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs(data)).Option("missingkey=zero").Parse(text)
+}
+
+// render executes text as a template with data.
+func render(name, text string, data templateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := parseTemplate(name, text, data)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
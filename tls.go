@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tlsPollInterval is how often the certificate files are checked for changes.
+const tlsPollInterval = 10 * time.Second
+
+// certReloader serves the certificate and client CAs from disk, reloading
+// them on SIGHUP or when the files change.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the most recent modification time of the files.
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile, c.caFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		data, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in '%s'", c.caFile)
+		}
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.pool = pool
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// watch reloads the certificates on SIGHUP or when the files change.
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(tlsPollInterval)
+	for {
+		select {
+		case <-hup:
+		case <-tick.C:
+			modTime, err := c.latestModTime()
+			c.mu.RLock()
+			unchanged := err != nil || !modTime.After(c.modTime)
+			c.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := c.reload(); err != nil {
+			log.WithField("error", err).Error("Failed to reload TLS certificates, keeping the old ones!")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"cert":      c.certFile,
+			"client-ca": c.caFile,
+		}).Info("Reloaded TLS certificates.")
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// config returns a TLS config that always uses the current certificates.
+// Client certificates are verified if given, runbooks decide whether they
+// are required.
+func (c *certReloader) config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			pool := c.pool
+			c.mu.RUnlock()
+			cfg := &tls.Config{GetCertificate: c.getCertificate}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// clientCertRule matches a verified client certificate. Every field that is
+// set must match; CN and SAN are path.Match patterns, Fingerprint is the
+// SHA-256 of the certificate in hex, optionally with colons and a "sha256:"
+// prefix.
+type clientCertRule struct {
+	CN          string `json:"cn,omitempty"`
+	SAN         string `json:"san,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.TrimPrefix(strings.ToLower(fp), "sha256:"))
+	return strings.Replace(fp, ":", "", -1)
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+func (rule clientCertRule) matches(cert *x509.Certificate) bool {
+	if rule.CN == "" && rule.SAN == "" && rule.Fingerprint == "" {
+		return false
+	}
+	if rule.CN != "" {
+		if ok, _ := path.Match(rule.CN, cert.Subject.CommonName); !ok {
+			return false
+		}
+	}
+	if rule.SAN != "" {
+		found := false
+		for _, san := range certSANs(cert) {
+			if ok, _ := path.Match(rule.SAN, san); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.Fingerprint != "" {
+		sum := sha256.Sum256(cert.Raw)
+		if normalizeFingerprint(rule.Fingerprint) != hex.EncodeToString(sum[:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientCertCN returns the common name of the connection's verified client
+// certificate, if there is one.
+func clientCertCN(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/hex"
+  "encoding/pem"
+  "io/ioutil"
+  "math/big"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/gorilla/mux"
+)
+
+type testCert struct {
+  cert    *x509.Certificate
+  key     *ecdsa.PrivateKey
+  certPEM []byte
+  keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, client bool) *testCert {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tmpl := &x509.Certificate{
+    SerialNumber: big.NewInt(time.Now().UnixNano()),
+    Subject:      pkix.Name{CommonName: cn},
+    NotBefore:    time.Now().Add(-time.Hour),
+    NotAfter:     time.Now().Add(time.Hour),
+    DNSNames:     []string{cn},
+    IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+  }
+  signer, signerKey := tmpl, key
+  if parent == nil {
+    tmpl.IsCA = true
+    tmpl.BasicConstraintsValid = true
+    tmpl.KeyUsage = x509.KeyUsageCertSign
+  } else {
+    signer, signerKey = parent.cert, parent.key
+    tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+    if client {
+      tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+    }
+  }
+  der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cert, _ := x509.ParseCertificate(der)
+  keyDER, _ := x509.MarshalECPrivateKey(key)
+  return &testCert{
+    cert:    cert,
+    key:     key,
+    certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+    keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+  }
+}
+
+func TestClientCertRules(t *testing.T) {
+  ca := newTestCert(t, "ca", nil, false)
+  c := newTestCert(t, "deploy.example.com", ca, true)
+  sum := sha256.Sum256(c.cert.Raw)
+  fp := hex.EncodeToString(sum[:])
+
+  tests := []struct {
+    rule clientCertRule
+    want bool
+  }{
+    {clientCertRule{CN: "deploy.*"}, true},
+    {clientCertRule{CN: "build.*"}, false},
+    {clientCertRule{SAN: "*.example.com"}, true},
+    {clientCertRule{SAN: "127.0.0.1"}, true},
+    {clientCertRule{SAN: "*.example.org"}, false},
+    {clientCertRule{Fingerprint: "sha256:" + fp}, true},
+    {clientCertRule{Fingerprint: fp[:2] + ":" + fp[2:]}, true},
+    {clientCertRule{Fingerprint: "00"}, false},
+    {clientCertRule{CN: "deploy.*", Fingerprint: "00"}, false},
+    {clientCertRule{}, false},
+  }
+  for _, tt := range tests {
+    if got := tt.rule.matches(c.cert); got != tt.want {
+      t.Errorf("%+v.matches: wanted %v, got %v", tt.rule, tt.want, got)
+    }
+  }
+
+  r := runBook{AllowedCerts: []clientCertRule{{CN: "deploy.*"}}}
+  if r.ClientCertIsAllowed(nil) {
+    t.Errorf("ClientCertIsAllowed without TLS unexpectedly succeeded")
+  }
+  if !r.ClientCertIsAllowed(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{c.cert, ca.cert}}}) {
+    t.Errorf("ClientCertIsAllowed with matching cert failed")
+  }
+}
+
+func TestMutualTLS(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  configdir = dir
+  queue, _ = newJobQueue("", 0)
+  script := `{"allowedClientCerts": [{"cn": "deploy"}], "scripts": [{"command": "echo"}]}`
+  if err := ioutil.WriteFile(filepath.Join(dir, "mtls.json"), []byte(script), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  ca := newTestCert(t, "ca", nil, false)
+  server := newTestCert(t, "localhost", ca, false)
+  files := map[string][]byte{"ca.pem": ca.certPEM, "cert.pem": server.certPEM, "key.pem": server.keyPEM}
+  for name, data := range files {
+    if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+      t.Fatal(err)
+    }
+  }
+  certs, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  r := mux.NewRouter()
+  r.HandleFunc("/{id}", hookHandler).Methods("POST")
+  ts := httptest.NewUnstartedServer(r)
+  ts.TLS = certs.config()
+  ts.StartTLS()
+  defer ts.Close()
+
+  roots := x509.NewCertPool()
+  roots.AddCert(ca.cert)
+  tests := []struct {
+    cn         string
+    statusCode int
+  }{
+    {"", 401},
+    {"build", 401},
+    {"deploy", 200},
+  }
+  for _, tt := range tests {
+    cfg := &tls.Config{RootCAs: roots}
+    if tt.cn != "" {
+      c := newTestCert(t, tt.cn, ca, true)
+      pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+      if err != nil {
+        t.Fatal(err)
+      }
+      cfg.Certificates = []tls.Certificate{pair}
+    }
+    client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+    resp, err := client.Post(ts.URL+"/mtls", "", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != tt.statusCode {
+      t.Errorf("client cert %q: wanted %d, got %d", tt.cn, tt.statusCode, resp.StatusCode)
+    }
+  }
+
+  // A new certificate is picked up on reload.
+  renewed := newTestCert(t, "localhost", ca, false)
+  ioutil.WriteFile(filepath.Join(dir, "cert.pem"), renewed.certPEM, 0600)
+  ioutil.WriteFile(filepath.Join(dir, "key.pem"), renewed.keyPEM, 0600)
+  if err := certs.reload(); err != nil {
+    t.Fatal(err)
+  }
+  got, _ := certs.getCertificate(nil)
+  if string(got.Certificate[0]) != string(renewed.cert.Raw) {
+    t.Errorf("reload did not pick up the new certificate")
+  }
+}
+
+func TestServeTLS(t *testing.T) {
+  log.SetLevel(log.ErrorLevel)
+
+  dir, err := ioutil.TempDir("", "captainhook")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  ca := newTestCert(t, "ca", nil, false)
+  server := newTestCert(t, "localhost", ca, false)
+  ioutil.WriteFile(filepath.Join(dir, "cert.pem"), server.certPEM, 0600)
+  ioutil.WriteFile(filepath.Join(dir, "key.pem"), server.keyPEM, 0600)
+  certs, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  addr := ln.Addr().String()
+  ln.Close()
+  // The admin listener is served like the hook listener.
+  s := &http.Server{Addr: addr, Handler: http.NotFoundHandler(), TLSConfig: certs.config()}
+  go serve(s)
+  defer s.Close()
+
+  pool := x509.NewCertPool()
+  pool.AddCert(ca.cert)
+  client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+  var resp *http.Response
+  for i := 0; i < 50; i++ {
+    if resp, err = client.Get("https://" + addr + "/"); err == nil {
+      break
+    }
+    time.Sleep(20 * time.Millisecond)
+  }
+  if err != nil {
+    t.Fatalf("wanted the server to speak TLS: %s", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusNotFound {
+    t.Errorf("wanted %d, got %d", http.StatusNotFound, resp.StatusCode)
+  }
+}